@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBatchSize bounds the number of links in one batch request
+	maxBatchSize = 10000
+	// maxBatchBody bounds the size of a batch request body
+	maxBatchBody = 32 << 20
+	// batchWorkers is how many items are validated concurrently, since
+	// validation may resolve hosts or follow third-party short links
+	batchWorkers = 8
+	// batchTimeout replaces the server's read and write timeouts for
+	// batch requests, which can take much longer than a single shorten
+	batchTimeout = 5 * time.Minute
+)
+
+// errBatchTooLarge is returned when a batch has more than maxBatchSize items
+var errBatchTooLarge = fmt.Errorf("batch exceeds %d items", maxBatchSize)
+
+// BatchResult is the outcome of one item of a batch, in request order.
+// Status is the code a single POST /shorten would have returned, except
+// that reused links report 200 rather than 201.
+type BatchResult struct {
+	Index  int `json:"index"`
+	Status int `json:"status"`
+	*ShortenResponse
+	Error string `json:"error,omitempty"`
+}
+
+// BatchResponse represents the response for a batch shorten request
+type BatchResponse struct {
+	Count     int           `json:"count"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// HandleBatchShorten handles POST requests creating many short URLs at
+// once. The body is a JSON array or a stream of newline-delimited JSON
+// objects, each a ShortenRequest. Items are validated independently and
+// then committed under a single store lock; failures are reported per
+// item without affecting the others.
+func (h *Handler) HandleBatchShorten(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	extendDeadlines(w)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBody)
+
+	items, err := readBatch(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, errBatchTooLarge) || errors.As(err, &tooLarge) {
+		h.respondError(w, fmt.Sprintf("Batch must contain at most %d items and %d MB", maxBatchSize, maxBatchBody>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		h.respondError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		h.respondError(w, "Batch must contain at least one item", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BatchResult, len(items))
+	plans := make([]*shortenPlan, len(items))
+	fail := func(i int, err error) {
+		message, statusCode := shortenErrorStatus(err)
+		results[i].Status, results[i].Error = statusCode, message
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchWorkers)
+	for i, item := range items {
+		results[i].Index = i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, item json.RawMessage) {
+			defer func() { <-sem; wg.Done() }()
+
+			var req ShortenRequest
+			if err := json.Unmarshal(item, &req); err != nil {
+				fail(i, &requestError{"Invalid request body", http.StatusBadRequest})
+				return
+			}
+			plan, err := h.planShorten(r, &req)
+			if err != nil {
+				fail(i, err)
+				return
+			}
+			plans[i] = plan
+		}(i, item)
+	}
+	wg.Wait()
+
+	// Commit in request order so later items can reuse earlier ones
+	h.store.Batch(func(tx *StoreTx) {
+		for i, plan := range plans {
+			if plan == nil {
+				continue
+			}
+			mapping, created, err := h.commitShorten(tx, plan)
+			if err != nil {
+				fail(i, err)
+				continue
+			}
+			results[i].Status = http.StatusOK
+			if created {
+				results[i].Status = http.StatusCreated
+			}
+			results[i].ShortenResponse = &ShortenResponse{
+				ShortCode:   mapping.ShortCode,
+				Domain:      mapping.Domain,
+				ShortURL:    h.shortURL(r, mapping.Domain, mapping.ShortCode),
+				OriginalURL: mapping.OriginalURL,
+			}
+		}
+	})
+
+	response := BatchResponse{Count: len(results), Results: results}
+	for _, result := range results {
+		if result.Error != "" {
+			response.Failed++
+		} else {
+			response.Succeeded++
+		}
+	}
+	h.respondJSON(w, http.StatusOK, response)
+}
+
+// extendDeadlines gives a bulk request batchTimeout to read its body and
+// write its response. Writers that cannot change deadlines are left alone.
+func extendDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(batchTimeout))
+	rc.SetWriteDeadline(time.Now().Add(batchTimeout))
+}
+
+// readBatch splits a batch body into its items. A body starting with '['
+// is a JSON array; anything else is read as a stream of JSON values such
+// as NDJSON.
+func readBatch(body io.Reader) ([]json.RawMessage, error) {
+	br := bufio.NewReader(body)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(br)
+	if first == '[' {
+		var items []json.RawMessage
+		if err := dec.Decode(&items); err != nil {
+			return nil, err
+		}
+		if len(items) > maxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		return items, nil
+	}
+
+	var items []json.RawMessage
+	for {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("item %d: %w", len(items), err)
+		}
+		if len(items) == maxBatchSize {
+			return nil, errBatchTooLarge
+		}
+		items = append(items, item)
+	}
+}
+
+// peekNonSpace skips leading whitespace and returns the next byte without
+// consuming it
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
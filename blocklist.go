@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrDestinationBlocked is returned when a destination matches a blocklist
+var ErrDestinationBlocked = errors.New("destination blocked")
+
+// ReputationChecker decides whether a destination URL is safe to shorten
+type ReputationChecker interface {
+	Check(u *url.URL) error
+}
+
+// Blocklist is a ReputationChecker backed by a local file in the spirit
+// of Google Safe Browsing lists. Each non-comment line is either:
+//
+//	evil.example             a host, blocking it and its subdomains
+//	evil.example/phish/      a host and path prefix expression
+//	1f0c9a2b...              a hex SHA-256 hash (or 4-32 byte prefix) of an expression
+//
+// URLs are matched by hashing their host-suffix/path-prefix expressions
+// the same way Safe Browsing does, so hash-only lists work unchanged.
+type Blocklist struct {
+	path string
+
+	mu         sync.RWMutex
+	hashes     map[string]struct{} // full hashes and hash prefixes
+	prefixLens []int               // distinct entry lengths in hashes
+}
+
+// LoadBlocklist reads a blocklist file
+func LoadBlocklist(path string) (*Blocklist, error) {
+	b := &Blocklist{path: path}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload re-reads the blocklist file. On error the current list is kept.
+func (b *Blocklist) Reload() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]struct{})
+	lens := make(map[int]bool)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var entry []byte
+		if isHashEntry(line) {
+			entry, _ = hex.DecodeString(line)
+		} else {
+			expr, err := blocklistExpression(line)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", b.path, lineNo, err)
+			}
+			sum := sha256.Sum256([]byte(expr))
+			entry = sum[:]
+		}
+		hashes[string(entry)] = struct{}{}
+		lens[len(entry)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	prefixLens := make([]int, 0, len(lens))
+	for n := range lens {
+		prefixLens = append(prefixLens, n)
+	}
+	sort.Ints(prefixLens)
+
+	b.mu.Lock()
+	b.hashes = hashes
+	b.prefixLens = prefixLens
+	b.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of loaded entries
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.hashes)
+}
+
+// Check returns ErrDestinationBlocked if any expression of u is listed
+func (b *Blocklist) Check(u *url.URL) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, expr := range lookupExpressions(u) {
+		sum := sha256.Sum256([]byte(expr))
+		for _, n := range b.prefixLens {
+			if _, ok := b.hashes[string(sum[:n])]; ok {
+				return ErrDestinationBlocked
+			}
+		}
+	}
+	return nil
+}
+
+// isHashEntry reports whether a line is a hex hash or hash prefix
+func isHashEntry(line string) bool {
+	if len(line) < 8 || len(line) > 64 || len(line)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(line); i++ {
+		if !isHex(line[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// blocklistExpression canonicalizes a host or host/path line
+func blocklistExpression(line string) (string, error) {
+	if !strings.Contains(line, "://") {
+		line = "http://" + line
+	}
+	u, err := url.Parse(line)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid entry %q", line)
+	}
+
+	expr := strings.Trim(strings.ToLower(u.Hostname()), ".") + u.EscapedPath()
+	if u.EscapedPath() == "" {
+		expr += "/"
+	}
+	if u.RawQuery != "" {
+		expr += "?" + u.RawQuery
+	}
+	return expr, nil
+}
+
+// lookupExpressions returns the host-suffix/path-prefix combinations
+// checked for a URL, following the Safe Browsing lookup rules.
+func lookupExpressions(u *url.URL) []string {
+	host := strings.Trim(strings.ToLower(u.Hostname()), ".")
+
+	hosts := []string{host}
+	if net.ParseIP(host) == nil {
+		labels := strings.Split(host, ".")
+		// Start from the last five components, never the bare TLD
+		start := len(labels) - 5
+		if start < 1 {
+			start = 1
+		}
+		for i := start; i < len(labels)-1; i++ {
+			hosts = append(hosts, strings.Join(labels[i:], "."))
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var paths []string
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+	paths = append(paths, path)
+	// NormalizeURL drops trailing slashes, so also try the directory form
+	if !strings.HasSuffix(path, "/") {
+		paths = append(paths, path+"/")
+	}
+	prefix := "/"
+	if path != prefix {
+		paths = append(paths, prefix)
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i < len(segments)-1 && i < 3; i++ {
+		prefix += segments[i] + "/"
+		if prefix != path {
+			paths = append(paths, prefix)
+		}
+	}
+
+	exprs := make([]string, 0, len(hosts)*len(paths))
+	for _, h := range hosts {
+		for _, p := range paths {
+			exprs = append(exprs, h+p)
+		}
+	}
+	return exprs
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxChainHops bounds how many short links are followed when resolving
+// a destination that points at another shortener
+const maxChainHops = 10
+
+// expandTimeout bounds each request to a third-party shortener, like the
+// DNS lookups of checkNetworkURL. The request context alone is not enough:
+// the server's write timeout does not cancel it.
+const expandTimeout = 3 * time.Second
+
+var (
+	// ErrRedirectLoop is returned when a chain of short links leads back to itself
+	ErrRedirectLoop = errors.New("destination forms a redirect loop")
+	// ErrRedirectChainTooLong is returned when a chain exceeds maxChainHops
+	ErrRedirectChainTooLong = errors.New("destination redirect chain is too long")
+	// ErrUnknownShortLink is returned for links to missing codes on our own host
+	ErrUnknownShortLink = errors.New("destination is an unknown short link")
+	// ErrConditionalShortLink is returned for links to our own codes that
+	// have a password, preview, schedule, rules or variants, whose target
+	// cannot be copied without bypassing them
+	ErrConditionalShortLink = errors.New("destination is a short link with its own options")
+)
+
+// DefaultShortenerDomains lists well-known third-party URL shorteners
+var DefaultShortenerDomains = []string{
+	"bit.ly",
+	"bitly.com",
+	"buff.ly",
+	"cutt.ly",
+	"goo.gl",
+	"is.gd",
+	"lnkd.in",
+	"ow.ly",
+	"rb.gy",
+	"rebrand.ly",
+	"shorturl.at",
+	"t.co",
+	"t.ly",
+	"tiny.cc",
+	"tinyurl.com",
+}
+
+// HTTPDoer is the subset of *http.Client used to expand short links
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// ShortenerExpander follows links on known third-party shorteners one
+// hop at a time so every intermediate destination can be inspected.
+type ShortenerExpander struct {
+	client  HTTPDoer
+	domains map[string]bool
+	timeout time.Duration // per request
+}
+
+// NewShortenerExpander creates an expander for the given domains. The
+// client should not follow redirects itself; if it does, only the final
+// URL is reported.
+func NewShortenerExpander(client HTTPDoer, domains []string) *ShortenerExpander {
+	e := &ShortenerExpander{client: client, domains: make(map[string]bool), timeout: expandTimeout}
+	for _, domain := range domains {
+		e.domains[strings.ToLower(domain)] = true
+	}
+	return e
+}
+
+// NewRedirectlessClient returns an http.Client suitable for an expander
+func NewRedirectlessClient() *http.Client {
+	return &http.Client{
+		Timeout: expandTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Handles reports whether host belongs to a known shortener
+func (e *ShortenerExpander) Handles(host string) bool {
+	return e.domains[strings.TrimPrefix(strings.ToLower(host), "www.")]
+}
+
+// Expand returns the URL that u redirects to, or u itself if the
+// shortener does not redirect.
+func (e *ShortenerExpander) Expand(ctx context.Context, u *url.URL) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		location, err := resp.Location()
+		if err != nil {
+			return "", fmt.Errorf("redirect without location from %s", u.Host)
+		}
+		return location.String(), nil
+	}
+	if resp.Request != nil && resp.Request.URL != nil {
+		return resp.Request.URL.String(), nil
+	}
+	return u.String(), nil
+}
+
+// resolveChain follows destinations that are short links, either on this
+// service or (with an expander) on known third-party shorteners, and
+// returns the final normalized target. Cycles are rejected.
+func (h *Handler) resolveChain(r *http.Request, destination string) (string, error) {
+	visited := make(map[string]bool)
+	current := destination
+	for hops := 0; ; hops++ {
+		if visited[current] {
+			return "", ErrRedirectLoop
+		}
+		visited[current] = true
+		if hops > maxChainHops {
+			return "", ErrRedirectChainTooLong
+		}
+
+		u, err := url.Parse(current)
+		if err != nil {
+			return "", err
+		}
+
+		if key, ok := h.ownShortLink(r, u); ok {
+			mapping, err := h.store.Get(key)
+			if err != nil {
+				return "", ErrUnknownShortLink
+			}
+			if !mapping.isPlain() {
+				return "", ErrConditionalShortLink
+			}
+			current = mapping.OriginalURL
+			continue
+		}
+
+		if h.expander == nil || !h.expander.Handles(u.Hostname()) {
+			return current, nil
+		}
+		if err := h.checkNetworkURL(r.Context(), u); err != nil {
+			return "", err
+		}
+		next, err := h.expander.Expand(r.Context(), u)
+		if err != nil {
+			return "", fmt.Errorf("expand %s: %w", u.Host, err)
+		}
+		if !ValidateURL(next) {
+			return "", fmt.Errorf("expand %s: invalid target", u.Host)
+		}
+		if next, err = NormalizeURLWithOptions(next, h.normalize.destination()); err != nil {
+			return "", err
+		}
+		if next == current {
+			return current, nil
+		}
+		current = next
+	}
+}
+
+// ownShortLink reports whether u is a short link served by this instance,
+// on the configured base URL, one of the short domains or the host the
+// request came in on, and returns its store key.
+func (h *Handler) ownShortLink(r *http.Request, u *url.URL) (string, bool) {
+	host := strings.ToLower(u.Host)
+	_, requestHost := h.origin(r)
+	path := u.Path
+	var domain string
+	switch {
+	case sameHost(host, strings.ToLower(requestHost), u.Scheme):
+		domain = h.hostDomain(r)
+	case h.baseURL != nil && sameHost(host, strings.ToLower(h.baseURL.Host), u.Scheme):
+		// Short links on the base URL live under its path, if any
+		prefix := strings.TrimRight(h.baseURL.Path, "/")
+		if !strings.HasPrefix(path, prefix+"/") {
+			return "", false
+		}
+		path = strings.TrimPrefix(path, prefix)
+	case h.isShortDomain(u.Hostname()):
+		domain, _ = h.domainFor(u.Hostname())
+	default:
+		return "", false
+	}
+
+	code := strings.TrimPrefix(path, "/")
+	if !isExistingShortCode(code) {
+		return "", false
+	}
+	return linkKey(domain, code), true
+}
+
+// sameHost compares two hosts, treating an omitted default port as equal
+func sameHost(a, b, scheme string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	defaultPort := ":80"
+	if scheme == "https" {
+		defaultPort = ":443"
+	}
+	return strings.TrimSuffix(a, defaultPort) == strings.TrimSuffix(b, defaultPort)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDoer answers HEAD requests from a table of redirects, so expansion
+// runs offline. URLs missing from the table respond 200.
+type fakeDoer map[string]string
+
+func (f fakeDoer) Do(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+	if location, ok := f[req.URL.String()]; ok {
+		resp.StatusCode = http.StatusMovedPermanently
+		resp.Header.Set("Location", location)
+	}
+	return resp, nil
+}
+
+// stalledDoer is a shortener that never answers, only giving up when the
+// request is canceled
+type stalledDoer struct{}
+
+func (stalledDoer) Do(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+// newChainHandler creates a handler serving sho.rt with the given links
+// on the default domain
+func newChainHandler(t *testing.T, links map[string]string) *Handler {
+	t.Helper()
+	h := NewHandler(NewURLStore())
+	h.baseURL, _ = url.Parse("https://sho.rt")
+	h.expander = NewShortenerExpander(fakeDoer{
+		"https://bit.ly/one":   "https://bit.ly/two",
+		"https://bit.ly/two":   "https://8.8.8.8/final",
+		"https://bit.ly/own":   "https://sho.rt/abc",
+		"https://bit.ly/loopa": "https://bit.ly/loopb",
+		"https://bit.ly/loopb": "https://bit.ly/loopa",
+		"https://t.co/back":    "https://sho.rt/back",
+	}, DefaultShortenerDomains)
+	for code, destination := range links {
+		if err := h.store.Save(&URLMapping{ShortCode: code, OriginalURL: destination}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+func TestResolveChain(t *testing.T) {
+	h := newChainHandler(t, map[string]string{
+		"abc":  "https://8.8.8.8/target",
+		"hop":  "https://sho.rt/abc",
+		"back": "https://t.co/back",
+	})
+
+	tests := []struct {
+		destination string
+		want        string
+		wantErr     error
+	}{
+		{"https://8.8.8.8/plain", "https://8.8.8.8/plain", nil},
+		{"https://sho.rt/abc", "https://8.8.8.8/target", nil},
+		{"https://sho.rt/hop", "https://8.8.8.8/target", nil},
+		{"http://localhost:8080/abc", "https://8.8.8.8/target", nil},
+		{"https://bit.ly/one", "https://8.8.8.8/final", nil},
+		{"https://bit.ly/own", "https://8.8.8.8/target", nil},
+		{"https://bit.ly/unlisted", "https://bit.ly/unlisted", nil},
+		{"https://sho.rt/missing", "", ErrUnknownShortLink},
+		{"https://bit.ly/loopa", "", ErrRedirectLoop},
+		{"https://sho.rt/back", "", ErrRedirectLoop},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "http://localhost:8080/shorten", nil)
+		got, err := h.resolveChain(r, tt.destination)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("resolveChain(%s) error = %v, want %v", tt.destination, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveChain(%s) = %q, %v, want %q", tt.destination, got, err, tt.want)
+		}
+	}
+}
+
+func TestShortenRefusesProtectedShortLink(t *testing.T) {
+	h := newChainHandler(t, nil)
+	hash, err := HashPassword("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := &URLMapping{ShortCode: "locked", OriginalURL: "https://8.8.8.8/secret", PasswordHash: hash, Protected: true}
+	if err := h.store.Save(locked); err != nil {
+		t.Fatal(err)
+	}
+
+	h.expander = NewShortenerExpander(fakeDoer{"https://bit.ly/locked": "https://sho.rt/locked"}, DefaultShortenerDomains)
+
+	for _, destination := range []string{"https://sho.rt/locked", "https://bit.ly/locked"} {
+		body := `{"url": "` + destination + `"}`
+		r := httptest.NewRequest(http.MethodPost, "http://sho.rt/shorten", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.HandleShorten(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("shorten %s: status %d, want %d", destination, w.Code, http.StatusBadRequest)
+		}
+		if strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("shorten %s: response reveals the protected destination: %s", destination, w.Body)
+		}
+	}
+	if n := h.store.Count(); n != 1 {
+		t.Errorf("store has %d links, want only the protected one", n)
+	}
+}
+
+func TestResolveChainScheduledShortLink(t *testing.T) {
+	h := newChainHandler(t, nil)
+	later := time.Now().Add(time.Hour)
+	launch := &URLMapping{ShortCode: "launch", OriginalURL: "https://8.8.8.8/launch-plans", NotBefore: &later}
+	if err := h.store.Save(launch); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost:8080/shorten", nil)
+	got, err := h.resolveChain(r, "http://localhost:8080/launch")
+	if !errors.Is(err, ErrConditionalShortLink) {
+		t.Errorf("resolveChain = %q, %v, want %v", got, err, ErrConditionalShortLink)
+	}
+}
+
+func TestExpandTimeout(t *testing.T) {
+	e := NewShortenerExpander(stalledDoer{}, DefaultShortenerDomains)
+	e.timeout = 10 * time.Millisecond
+	u, _ := url.Parse("https://bit.ly/slow")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.Expand(context.Background(), u)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expand error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expand did not give up on a stalled shortener")
+	}
+
+	if client := NewRedirectlessClient(); client.Timeout <= 0 {
+		t.Errorf("redirectless client has no timeout")
+	}
+}
+
+func TestResolveChainTooLong(t *testing.T) {
+	links := make(map[string]string)
+	for i := 0; i <= maxChainHops+1; i++ {
+		links["hop"+string(rune('a'+i))] = "https://sho.rt/hop" + string(rune('a'+i+1))
+	}
+	h := newChainHandler(t, links)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost:8080/shorten", nil)
+	if _, err := h.resolveChain(r, "https://sho.rt/hopa"); !errors.Is(err, ErrRedirectChainTooLong) {
+		t.Errorf("resolveChain error = %v, want %v", err, ErrRedirectChainTooLong)
+	}
+}
+
+func TestOwnShortLink(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	h.baseURL, _ = url.Parse("https://team.io/s")
+	h.domains = []string{"team.io", "go.team.io"}
+
+	tests := []struct {
+		link   string
+		want   string
+		isOwn  bool
+		reason string
+	}{
+		{"https://team.io/s/abc", "abc", true, "base URL path"},
+		{"https://team.io/abc", "", false, "outside the base URL path"},
+		{"https://go.team.io/abc", "go.team.io/abc", true, "other short domain"},
+		{"http://localhost:8080/abc", "abc", true, "request host"},
+		{"https://go.team.io/a/b", "", false, "not a code"},
+		{"https://example.com/abc", "", false, "foreign host"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "http://localhost:8080/shorten", nil)
+		u, _ := url.Parse(tt.link)
+		got, ok := h.ownShortLink(r, u)
+		if ok != tt.isOwn || got != tt.want {
+			t.Errorf("%s: ownShortLink(%s) = %q, %v, want %q, %v", tt.reason, tt.link, got, ok, tt.want, tt.isOwn)
+		}
+	}
+}
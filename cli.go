@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const cliUsage = `Usage: url-shortener [command] [flags]
+
+Without a command, the server is started; flags before any command are
+server flags (see "url-shortener serve -h").
+
+Commands:
+  serve     Start the server
+  shorten   Create a short link
+  list      List all links
+  get       Show one link
+  delete    Delete a link
+  export    Write all links as JSON or CSV
+  import    Import links from an export file
+  stats     Show link and click totals
+
+Commands other than serve talk to a running server (-server, default
+$SHORTENER_SERVER or http://localhost:$PORT), or work directly on a store
+file with -store. Do not use -store on a file a running server is using,
+since the server overwrites it with its own copy.
+
+Run "url-shortener <command> -h" for the flags of a command.
+`
+
+// Output formats of the management commands
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+// runCommand runs a command-line subcommand and returns the exit status
+func runCommand(args []string) int {
+	commands := map[string]func([]string) int{
+		"shorten": runShorten,
+		"list":    runList,
+		"get":     runGet,
+		"delete":  runDelete,
+		"export":  runExport,
+		"import":  runImport,
+		"stats":   runStats,
+	}
+	switch name := args[0]; {
+	case name == "serve":
+		return serve(args[1:])
+	case name == "help" || name == "-h" || name == "-help" || name == "--help":
+		fmt.Print(cliUsage)
+		return 0
+	case strings.HasPrefix(name, "-"):
+		// Server flags without the serve command
+		return serve(args)
+	default:
+		run, ok := commands[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, cliUsage)
+			return 2
+		}
+		return run(args[1:])
+	}
+}
+
+// defaultServer is the base URL commands talk to unless -server is given
+func defaultServer() string {
+	if v := os.Getenv("SHORTENER_SERVER"); v != "" {
+		return v
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	return "http://localhost:" + port
+}
+
+// commandFlags are the flags shared by the management commands
+type commandFlags struct {
+	server    string
+	storeFile string
+	output    string
+}
+
+// newCommand creates the flag set of a management command. usage is the
+// argument synopsis shown by -h.
+func newCommand(name, usage string) (*flag.FlagSet, *commandFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: url-shortener %s [flags] %s\n\n", name, usage)
+		fs.PrintDefaults()
+	}
+	cf := &commandFlags{}
+	fs.StringVar(&cf.server, "server", defaultServer(), "base URL of the running service")
+	fs.StringVar(&cf.storeFile, "store", "", "work directly on this store file instead of a server")
+	fs.StringVar(&cf.output, "output", OutputTable, "output format: table or json")
+	return fs, cf
+}
+
+// parse parses the command line and checks the shared flags and the number
+// of positional arguments. It reports false after printing the problem.
+func (cf *commandFlags) parse(fs *flag.FlagSet, args []string, nargs int) bool {
+	if err := fs.Parse(args); err != nil {
+		return false
+	}
+	if cf.output != OutputTable && cf.output != OutputJSON {
+		fmt.Fprintf(os.Stderr, "invalid -output %q: use table or json\n", cf.output)
+		return false
+	}
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return false
+	}
+	return true
+}
+
+// apiClient calls the service API, either over the network or, for a
+// store file, by serving each request in process with the same handlers
+type apiClient struct {
+	base string
+	http *http.Client
+
+	// store and storeFile are set when working on a store file; the file
+	// is rewritten by close if a command changed the store
+	store     *URLStore
+	storeFile string
+	changes   uint64
+}
+
+// connect returns a client for the server or store file named by the flags
+func (cf *commandFlags) connect() (*apiClient, error) {
+	if cf.storeFile == "" {
+		return &apiClient{
+			base: strings.TrimRight(cf.server, "/"),
+			http: &http.Client{Timeout: batchTimeout},
+		}, nil
+	}
+
+	// Links are vetted and generated as the server would, using its
+	// configuration from the environment and SHORTENER_CONFIG
+	cfg, _, err := LoadConfig(nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	store, err := LoadStoreFile(cf.storeFile)
+	if err != nil {
+		return nil, err
+	}
+	handler, _, err := newConfiguredHandler(cfg, store)
+	if err != nil {
+		return nil, err
+	}
+	handler.revealProtected = true // whoever can read the store file sees it all
+
+	// Short URLs are built from the request host, so requests go to the
+	// public base URL when one is configured
+	base := "http://localhost"
+	if cfg.BaseURL != "" {
+		base = strings.TrimRight(cfg.BaseURL, "/")
+	}
+
+	return &apiClient{
+		base:      base,
+		http:      &http.Client{Transport: handlerTransport{newMux(handler)}},
+		store:     store,
+		storeFile: cf.storeFile,
+		changes:   store.Changes(),
+	}, nil
+}
+
+// close saves the store file if the command modified it
+func (c *apiClient) close() error {
+	if c.store == nil || c.store.Changes() == c.changes {
+		return nil
+	}
+	return c.store.WriteFile(c.storeFile)
+}
+
+// do sends a request and returns the response if its status is one of ok.
+// Any other status is turned into an error carrying the API's message.
+func (c *apiClient) do(method, path, contentType string, body io.Reader, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	var apiErr ErrorResponse
+	if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+		return nil, errors.New(apiErr.Error)
+	}
+	return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+}
+
+// getJSON sends an optional JSON body and decodes the JSON response of a
+// successful request into v
+func (c *apiClient) getJSON(method, path string, body io.Reader, v interface{}) error {
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+	resp, err := c.do(method, path, contentType, body, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
+
+// handlerTransport serves requests with an in-process handler
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+	rw := &responseBuffer{header: make(http.Header)}
+	t.handler.ServeHTTP(rw, req)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rw.status, http.StatusText(rw.status)),
+		StatusCode:    rw.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.header,
+		Body:          io.NopCloser(&rw.body),
+		ContentLength: int64(rw.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// responseBuffer is an http.ResponseWriter that keeps the response in memory
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *responseBuffer) Header() http.Header { return rw.header }
+
+func (rw *responseBuffer) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *responseBuffer) Write(p []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.body.Write(p)
+}
+
+// linkPath is the API path of a short code on a domain
+func linkPath(code, domain string) string {
+	path := "/api/urls/" + url.PathEscape(code)
+	if domain != "" {
+		path += "?domain=" + url.QueryEscape(domain)
+	}
+	return path
+}
+
+// isFlagSet reports whether a flag was given on the command line
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// finish closes the client and turns err into an exit status
+func finish(client *apiClient, err error) int {
+	if closeErr := client.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("save store: %v", closeErr)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// runShorten creates a short link with POST /shorten
+func runShorten(args []string) int {
+	fs, cf := newCommand("shorten", "URL")
+	var req ShortenRequest
+	fs.StringVar(&req.Domain, "domain", "", "short domain to create the link on (default domain if empty)")
+	fs.StringVar(&req.CustomCode, "code", "", "custom short code")
+	fs.StringVar(&req.Dedupe, "dedupe", "", "if the URL was already shortened: reuse, always-new or fail-if-exists")
+	fs.StringVar(&req.Password, "password", "", "password visitors must enter")
+	fs.BoolVar(&req.Preview, "preview", false, "show a preview page before redirecting")
+	if !cf.parse(fs, args, 1) {
+		return 2
+	}
+	req.URL = fs.Arg(0)
+
+	client, err := cf.connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	body, _ := json.Marshal(req)
+	var resp ShortenResponse
+	err = client.getJSON(http.MethodPost, "/shorten", bytes.NewReader(body), &resp)
+	if err == nil {
+		if cf.output == OutputJSON {
+			printJSON(resp)
+		} else {
+			fmt.Println(resp.ShortURL)
+		}
+	}
+	return finish(client, err)
+}
+
+// runList prints every link from GET /api/urls, oldest first
+func runList(args []string) int {
+	fs, cf := newCommand("list", "")
+	domain := fs.String("domain", "", "only list links on this short domain")
+	if !cf.parse(fs, args, 0) {
+		return 2
+	}
+	path := "/api/urls"
+	if isFlagSet(fs, "domain") {
+		path += "?domain=" + url.QueryEscape(*domain)
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var resp struct {
+		Count int         `json:"count"`
+		URLs  []ListedURL `json:"urls"`
+	}
+	err = client.getJSON(http.MethodGet, path, nil, &resp)
+	if err == nil {
+		sort.SliceStable(resp.URLs, func(i, j int) bool {
+			return resp.URLs[i].CreatedAt.Before(resp.URLs[j].CreatedAt)
+		})
+		if cf.output == OutputJSON {
+			printJSON(resp)
+		} else {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "CODE\tCLICKS\tCREATED\tDESTINATION")
+			for _, m := range resp.URLs {
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", m.key(), m.Clicks, m.CreatedAt.Local().Format(time.DateTime), shownDestination(m.URLMapping))
+			}
+			tw.Flush()
+		}
+	}
+	return finish(client, err)
+}
+
+// runGet prints one link from GET /api/urls/{code}
+func runGet(args []string) int {
+	fs, cf := newCommand("get", "CODE")
+	domain := fs.String("domain", "", "short domain of the code (default domain if empty)")
+	if !cf.parse(fs, args, 1) {
+		return 2
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var link ListedURL
+	err = client.getJSON(http.MethodGet, linkPath(fs.Arg(0), *domain), nil, &link)
+	if err == nil {
+		if cf.output == OutputJSON {
+			printJSON(link)
+		} else {
+			printLink(os.Stdout, link)
+		}
+	}
+	return finish(client, err)
+}
+
+// shownDestination returns the destination to print; servers hide those
+// of protected links
+func shownDestination(m *URLMapping) string {
+	if m.OriginalURL == "" && m.Protected {
+		return "(hidden)"
+	}
+	return m.OriginalURL
+}
+
+// printLink prints a link as a two-column table of its set fields
+func printLink(w io.Writer, link ListedURL) {
+	m := link.URLMapping
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Code\t%s\n", m.ShortCode)
+	if m.Domain != "" {
+		fmt.Fprintf(tw, "Domain\t%s\n", m.Domain)
+	}
+	fmt.Fprintf(tw, "Short URL\t%s\n", link.ShortURL)
+	fmt.Fprintf(tw, "Destination\t%s\n", shownDestination(m))
+	fmt.Fprintf(tw, "Created\t%s\n", m.CreatedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(tw, "Clicks\t%d\n", m.Clicks)
+	if m.Protected {
+		fmt.Fprintln(tw, "Protected\tyes")
+	}
+	if m.Preview {
+		fmt.Fprintln(tw, "Preview\tyes")
+	}
+	if m.NotBefore != nil {
+		fmt.Fprintf(tw, "Not before\t%s\n", m.NotBefore.Local().Format(time.DateTime))
+	}
+	if m.NotAfter != nil {
+		fmt.Fprintf(tw, "Not after\t%s\n", m.NotAfter.Local().Format(time.DateTime))
+	}
+	if m.FallbackURL != "" {
+		fmt.Fprintf(tw, "Fallback\t%s\n", m.FallbackURL)
+	}
+	for _, rule := range m.Rules {
+		fmt.Fprintf(tw, "Platform %s\t%s\n", rule.Platform, rule.URL)
+	}
+	for _, rule := range m.GeoRules {
+		fmt.Fprintf(tw, "Countries %s\t%s\n", strings.Join(rule.Countries, ","), rule.URL)
+	}
+	tags := make([]string, 0, len(m.Languages))
+	for tag := range m.Languages {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		fmt.Fprintf(tw, "Language %s\t%s\n", tag, m.Languages[tag])
+	}
+	for _, v := range m.Variants {
+		fmt.Fprintf(tw, "Variant (weight %d, %d clicks)\t%s\n", v.Weight, v.Clicks, v.URL)
+	}
+	tw.Flush()
+}
+
+// runDelete deletes a link with DELETE /api/urls/{code}
+func runDelete(args []string) int {
+	fs, cf := newCommand("delete", "CODE")
+	domain := fs.String("domain", "", "short domain of the code (default domain if empty)")
+	if !cf.parse(fs, args, 1) {
+		return 2
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	code := fs.Arg(0)
+	resp, err := client.do(http.MethodDelete, linkPath(code, *domain), "", nil, http.StatusOK, http.StatusNoContent)
+	if err == nil {
+		resp.Body.Close()
+		if cf.output == OutputJSON {
+			printJSON(map[string]string{"deleted": code})
+		} else {
+			fmt.Printf("Deleted %s\n", code)
+		}
+	}
+	return finish(client, err)
+}
+
+// runExport writes GET /api/export to standard output. The -output flag
+// does not apply; the file format is chosen with -format. Only -store
+// exports include protected links and their password hashes.
+func runExport(args []string) int {
+	fs, cf := newCommand("export", "")
+	format := fs.String("format", "json", "json or csv")
+	if !cf.parse(fs, args, 0) {
+		return 2
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp, err := client.do(http.MethodGet, "/api/export?format="+url.QueryEscape(*format), "", nil, http.StatusOK)
+	if err == nil {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		resp.Body.Close()
+	}
+	return finish(client, err)
+}
+
+// runImport posts an export file to POST /api/import and prints the report
+func runImport(args []string) int {
+	fs, cf := newCommand("import", "FILE\n\nFILE may be - to read standard input.")
+	format := fs.String("format", "", "json, csv, bitly or yourls (json and csv are detected if omitted)")
+	conflict := fs.String("conflict", ConflictFail, "what to do with existing codes: skip, overwrite or fail")
+	dryRun := fs.Bool("dry-run", false, "report what would happen without importing")
+	if !cf.parse(fs, args, 1) {
+		return 2
+	}
+
+	var body io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		body = f
+	}
+
+	query := url.Values{"conflict": {*conflict}}
+	if *format != "" {
+		query.Set("format", *format)
+	}
+	if *dryRun {
+		query.Set("dry_run", "true")
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp, err := client.do(http.MethodPost, "/api/import?"+query.Encode(), "application/octet-stream", body, http.StatusOK, http.StatusConflict)
+	if err != nil {
+		return finish(client, fmt.Errorf("import failed: %v", err))
+	}
+	defer resp.Body.Close()
+
+	var report ImportReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return finish(client, fmt.Errorf("invalid response: %v", err))
+	}
+	if cf.output == OutputJSON {
+		printJSON(report)
+	} else {
+		printImportReport(os.Stdout, report, resp.StatusCode == http.StatusConflict)
+	}
+	if status := finish(client, nil); status != 0 || resp.StatusCode == http.StatusConflict {
+		return 1
+	}
+	return 0
+}
+
+func printImportReport(w io.Writer, report ImportReport, failed bool) {
+	switch {
+	case failed:
+		fmt.Fprintf(w, "Nothing imported: %d of %d codes already exist (use -conflict skip or overwrite)\n", len(report.Conflicts), report.Total)
+	case report.DryRun:
+		fmt.Fprintf(w, "Dry run: would import %d of %d records (create %d, overwrite %d), skip %d, %d invalid\n",
+			report.Created+report.Overwritten, report.Total, report.Created, report.Overwritten, report.Skipped, report.Invalid)
+	default:
+		fmt.Fprintf(w, "Imported %d of %d records (created %d, overwrote %d), skipped %d, %d invalid\n",
+			report.Created+report.Overwritten, report.Total, report.Created, report.Overwritten, report.Skipped, report.Invalid)
+	}
+	if len(report.Conflicts) > 0 {
+		fmt.Fprintf(w, "\nCodes that collided with existing links (%d):\n", len(report.Conflicts))
+		for _, code := range report.Conflicts {
+			fmt.Fprintf(w, "  %s\n", code)
+		}
+	}
+	if len(report.Errors) > 0 {
+		fmt.Fprintf(w, "\nInvalid records (%d):\n", len(report.Errors))
+		for _, e := range report.Errors {
+			if e.ShortCode != "" {
+				fmt.Fprintf(w, "  record %d (%s): %s\n", e.Record, e.ShortCode, e.Error)
+			} else {
+				fmt.Fprintf(w, "  record %d: %s\n", e.Record, e.Error)
+			}
+		}
+	}
+}
+
+// runStats prints the totals from GET /api/stats
+func runStats(args []string) int {
+	fs, cf := newCommand("stats", "")
+	if !cf.parse(fs, args, 0) {
+		return 2
+	}
+
+	client, err := cf.connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var stats StatsResponse
+	err = client.getJSON(http.MethodGet, "/api/stats", nil, &stats)
+	if err == nil {
+		if cf.output == OutputJSON {
+			printJSON(stats)
+		} else {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(tw, "Links\t%d\n", stats.URLs)
+			fmt.Fprintf(tw, "Destinations\t%d\n", stats.Destinations)
+			fmt.Fprintf(tw, "Protected\t%d\n", stats.Protected)
+			fmt.Fprintf(tw, "Clicks\t%d\n", stats.Clicks)
+			tw.Flush()
+			if len(stats.TopLinks) > 0 {
+				fmt.Println("\nMost clicked:")
+				tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(tw, "CODE\tCLICKS\tDESTINATION")
+				for _, m := range stats.TopLinks {
+					fmt.Fprintf(tw, "%s\t%d\t%s\n", m.ShortCode, m.Clicks, shownDestination(m))
+				}
+				tw.Flush()
+			}
+		}
+	}
+	return finish(client, err)
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings. Each setting is taken from, in order of
+// increasing precedence, its default, the config file, its environment
+// variable and its command-line flag.
+type Config struct {
+	Port            int
+	BaseURL         string
+	Domains         []string
+	CodeLength      int
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	ShutdownDelay   time.Duration
+
+	StoreFile    string
+	SaveInterval time.Duration
+
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSReloadInterval     time.Duration
+	HTTPRedirectPort      int
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+
+	LogLevel          string
+	LogFormat         string
+	LogRedirectSample float64
+
+	NormalizeSortQuery       bool
+	NormalizeStripTracking   bool
+	NormalizeTrackingParams  []string
+	NormalizeIDNHost         bool
+	NormalizePercentEncoding bool
+	NormalizeDotSegments     bool
+	NormalizeStripFragment   bool
+
+	AllowedNetworks  []string
+	TrustedProxies   []string
+	TrustForwarded   bool
+	ExpandShorteners bool
+
+	PreviewAll          bool
+	InactiveFallbackURL string
+
+	GeoIPFile        string
+	BlocklistFile    string
+	BlocklistRecheck bool
+}
+
+// Bounds of the generated code length; custom codes may be 3 to 20 long
+const (
+	minCodeLength = 4
+	maxCodeLength = 20
+)
+
+// configEnv lists settings whose environment variable does not follow the
+// SHORTENER_<NAME> pattern
+var configEnv = map[string]string{
+	"port": "PORT", // set by Cloud Run and Heroku
+}
+
+// listValue is a comma-separated list flag
+type listValue []string
+
+func (l *listValue) String() string { return strings.Join(*l, ",") }
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// configFlags registers every setting of c as a flag with its default
+func configFlags(fs *flag.FlagSet, c *Config) {
+	fs.IntVar(&c.Port, "port", 8080, "port to listen on")
+	fs.StringVar(&c.BaseURL, "base-url", "", "canonical public base URL that short links are built on, e.g. https://sho.rt")
+	fs.Var((*listValue)(&c.Domains), "domains", "comma-separated short domains links can be created on; the first is the default")
+	fs.IntVar(&c.CodeLength, "code-length", 6, fmt.Sprintf("length of generated short codes (%d-%d)", minCodeLength, maxCodeLength))
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 5*time.Second, "maximum time to read a request")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 10*time.Second, "maximum time to write a response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 120*time.Second, "how long idle keep-alive connections stay open")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for requests on shutdown")
+	fs.DurationVar(&c.ShutdownDelay, "shutdown-delay", 0, "how long /readyz fails on shutdown before the server stops accepting requests")
+	fs.StringVar(&c.StoreFile, "store-file", "", "file to load links from and save them to (in memory only if empty)")
+	fs.DurationVar(&c.SaveInterval, "save-interval", 5*time.Second, "how often changes are saved to the store file")
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", "", "certificate file (PEM, with intermediates) to serve HTTPS")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", "", "private key file (PEM) of the certificate")
+	fs.DurationVar(&c.TLSReloadInterval, "tls-reload-interval", 30*time.Second, "how often the certificate files are checked for changes")
+	fs.IntVar(&c.HTTPRedirectPort, "http-redirect-port", 0, "with HTTPS, also listen on this port and redirect HTTP to HTTPS (0 disables)")
+	fs.DurationVar(&c.HSTSMaxAge, "hsts-max-age", 0, "with HTTPS, send Strict-Transport-Security with this max-age (0 disables)")
+	fs.BoolVar(&c.HSTSIncludeSubdomains, "hsts-include-subdomains", false, "add includeSubDomains to the HSTS header")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "minimum level of log records: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", "json", "log record format: json or text")
+	fs.Float64Var(&c.LogRedirectSample, "log-redirect-sample", 1, "fraction (0-1) of successful redirects written to the access log")
+	fs.BoolVar(&c.NormalizeSortQuery, "normalize-sort-query", true, "ignore query parameter order when matching existing links")
+	fs.BoolVar(&c.NormalizeStripTracking, "normalize-strip-tracking", true, "ignore tracking parameters when matching existing links")
+	c.NormalizeTrackingParams = append([]string(nil), DefaultTrackingParams...)
+	fs.Var((*listValue)(&c.NormalizeTrackingParams), "normalize-tracking-params", "comma-separated tracking parameters; a trailing * matches a prefix")
+	fs.BoolVar(&c.NormalizeIDNHost, "normalize-idn-host", true, "convert internationalized destination hosts to punycode")
+	fs.BoolVar(&c.NormalizePercentEncoding, "normalize-percent-encoding", true, "decode unreserved percent-escapes and uppercase the rest")
+	fs.BoolVar(&c.NormalizeDotSegments, "normalize-dot-segments", true, "resolve . and .. path segments")
+	fs.BoolVar(&c.NormalizeStripFragment, "normalize-strip-fragment", false, "ignore the #fragment when matching existing links")
+	fs.Var((*listValue)(&c.AllowedNetworks), "allowed-networks", "comma-separated internal networks and hosts destinations may use")
+	fs.Var((*listValue)(&c.TrustedProxies), "trusted-proxies", "comma-separated proxy addresses whose X-Forwarded-For is trusted")
+	fs.BoolVar(&c.TrustForwarded, "trust-forwarded-headers", false, "take the scheme and host from X-Forwarded-Proto and X-Forwarded-Host set by trusted proxies")
+	fs.BoolVar(&c.ExpandShorteners, "expand-shorteners", false, "expand links on third-party shorteners before saving")
+	fs.BoolVar(&c.PreviewAll, "preview-all", false, "show the preview page for every link")
+	fs.StringVar(&c.InactiveFallbackURL, "inactive-fallback-url", "", "where links outside their activation window redirect")
+	fs.StringVar(&c.GeoIPFile, "geoip-file", "", "IP-to-country CSV for geo rules")
+	fs.StringVar(&c.BlocklistFile, "blocklist-file", "", "destination blocklist, reloaded on SIGHUP")
+	fs.BoolVar(&c.BlocklistRecheck, "blocklist-recheck", false, "also check the blocklist when links are followed")
+}
+
+// configEnvName returns the environment variable of a setting
+func configEnvName(name string) string {
+	if env, ok := configEnv[name]; ok {
+		return env
+	}
+	return "SHORTENER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// LoadConfig builds the configuration from the command line, the
+// environment and the config file named by -config or SHORTENER_CONFIG.
+// printConfig reports whether -print-config was given. Errors from -h are
+// flag.ErrHelp.
+func LoadConfig(args []string) (cfg *Config, printConfig bool, err error) {
+	cfg = &Config{}
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: url-shortener [serve] [flags]\n\n"+
+			"Every flag can also be set with its environment variable (SHORTENER_ and the\n"+
+			"name in capitals, e.g. SHORTENER_BASE_URL; PORT for -port) or in the config\n"+
+			"file, e.g. base_url: https://sho.rt. Flags override the environment, which\n"+
+			"overrides the file.\n\n")
+		fs.PrintDefaults()
+	}
+	configFlags(fs, cfg)
+	configFile := fs.String("config", os.Getenv("SHORTENER_CONFIG"), "config file (JSON, or YAML/TOML-style key: value lines)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, v := range values {
+			where := *configFile
+			if v.line > 0 {
+				where += ":" + strconv.Itoa(v.line)
+			}
+			f := fs.Lookup(v.name)
+			if f == nil || f.Name == "config" || f.Name == "print-config" {
+				return nil, false, fmt.Errorf("%s: unknown setting %q", where, v.key)
+			}
+			if explicit[f.Name] {
+				continue
+			}
+			if err := f.Value.Set(v.value); err != nil {
+				return nil, false, fmt.Errorf("%s: invalid %s %q", where, v.key, v.value)
+			}
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		env := configEnvName(f.Name)
+		if v, ok := os.LookupEnv(env); ok && v != "" {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q", env, v))
+			}
+		}
+	})
+	if err := errors.Join(append(errs, cfg.Validate())...); err != nil {
+		return nil, false, err
+	}
+	return cfg, printConfig, nil
+}
+
+// Validate checks settings that parsed but are out of range or malformed
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(name, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		invalid("port", "must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil || !ValidateURL(c.BaseURL) || u.RawQuery != "" || u.Fragment != "" {
+			invalid("base-url", "must be an http:// or https:// URL without query or fragment, got %q", c.BaseURL)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, domain := range c.Domains {
+		domain = strings.ToLower(domain)
+		c.Domains[i] = domain
+		switch {
+		case !isDomainName(domain):
+			invalid("domains", "%q is not a host name", domain)
+		case seen[domain]:
+			invalid("domains", "%q is listed twice", domain)
+		}
+		seen[domain] = true
+	}
+	if c.BaseURL != "" && len(c.Domains) > 0 {
+		if u, err := url.Parse(c.BaseURL); err == nil && !strings.EqualFold(u.Hostname(), c.Domains[0]) {
+			invalid("base-url", "must be on the default (first) domain %s", c.Domains[0])
+		}
+	}
+	if c.CodeLength < minCodeLength || c.CodeLength > maxCodeLength {
+		invalid("code-length", "must be between %d and %d, got %d", minCodeLength, maxCodeLength, c.CodeLength)
+	}
+	for name, d := range map[string]time.Duration{
+		"read-timeout":        c.ReadTimeout,
+		"write-timeout":       c.WriteTimeout,
+		"idle-timeout":        c.IdleTimeout,
+		"shutdown-timeout":    c.ShutdownTimeout,
+		"save-interval":       c.SaveInterval,
+		"tls-reload-interval": c.TLSReloadInterval,
+	} {
+		if d <= 0 {
+			invalid(name, "must be positive, got %s", d)
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		invalid("tls-cert-file", "must be set together with tls-key-file")
+	}
+	if c.TLSCertFile == "" && c.HTTPRedirectPort != 0 {
+		invalid("http-redirect-port", "requires tls-cert-file and tls-key-file")
+	}
+	if c.HTTPRedirectPort != 0 && (c.HTTPRedirectPort < 1 || c.HTTPRedirectPort > 65535 || c.HTTPRedirectPort == c.Port) {
+		invalid("http-redirect-port", "must be between 1 and 65535 and differ from port, got %d", c.HTTPRedirectPort)
+	}
+	if c.ShutdownDelay < 0 {
+		invalid("shutdown-delay", "must not be negative, got %s", c.ShutdownDelay)
+	}
+	if c.HSTSMaxAge < 0 {
+		invalid("hsts-max-age", "must not be negative, got %s", c.HSTSMaxAge)
+	}
+	if c.TLSCertFile == "" && c.HSTSMaxAge > 0 {
+		invalid("hsts-max-age", "requires tls-cert-file and tls-key-file")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		invalid("log-level", "must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		invalid("log-format", "must be json or text, got %q", c.LogFormat)
+	}
+	if c.LogRedirectSample < 0 || c.LogRedirectSample > 1 {
+		invalid("log-redirect-sample", "must be between 0 and 1, got %g", c.LogRedirectSample)
+	}
+	if c.InactiveFallbackURL != "" && !ValidateURL(c.InactiveFallbackURL) {
+		invalid("inactive-fallback-url", "must be an http:// or https:// URL, got %q", c.InactiveFallbackURL)
+	}
+	if _, err := NewNetworkPolicy(nil, c.AllowedNetworks); err != nil {
+		invalid("allowed-networks", "%v", err)
+	}
+	if _, err := NewClientIPResolver(c.TrustedProxies); err != nil {
+		invalid("trusted-proxies", "%v", err)
+	}
+	if c.TrustForwarded && len(c.TrustedProxies) == 0 {
+		invalid("trust-forwarded-headers", "requires trusted-proxies")
+	}
+
+	// Report in a stable order
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// Print writes the configuration as a config file that LoadConfig accepts
+func (c *Config) Print(w io.Writer) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	values := *c
+	configFlags(fs, &values) // registering resets values to the defaults
+	values = *c
+	fs.VisitAll(func(f *flag.Flag) {
+		key := strings.ReplaceAll(f.Name, "-", "_")
+		value := f.Value.String()
+		if list, ok := f.Value.(*listValue); ok {
+			items := make([]string, len(*list))
+			for i, item := range *list {
+				items[i] = strconv.Quote(item)
+			}
+			value = "[" + strings.Join(items, ", ") + "]"
+		} else if _, err := strconv.ParseFloat(value, 64); err != nil && value != "true" && value != "false" {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(w, "%s: %s\n", key, value)
+	})
+}
+
+// configLine is one setting read from a config file
+type configLine struct {
+	line  int // 0 for JSON files
+	key   string
+	name  string // key in flag form
+	value string
+}
+
+// readConfigFile reads a config file: a JSON object for .json files, or
+// else lines of "key: value" or "key = value" as in flat YAML or TOML.
+// Lists are comma-separated or written as ["a", "b"].
+func readConfigFile(path string) ([]configLine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []configLine
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		lines, err = parseConfigJSON(data)
+	} else {
+		lines, err = parseConfigLines(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return lines, nil
+}
+
+func parseConfigJSON(data []byte) ([]configLine, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines []configLine
+	for _, key := range keys {
+		var value string
+		switch v := obj[key].(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case bool:
+			value = strconv.FormatBool(v)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: list items must be strings", key)
+				}
+				items[i] = s
+			}
+			value = strings.Join(items, ",")
+		case nil:
+			continue
+		default:
+			return nil, fmt.Errorf("%s: nested objects are not supported", key)
+		}
+		lines = append(lines, configLine{key: key, name: configFlagName(key), value: value})
+	}
+	return lines, nil
+}
+
+func parseConfigLines(data []byte) ([]configLine, error) {
+	var lines []configLine
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(stripComment(raw))
+		if line == "" || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: sections are not supported, use top-level keys", n)
+		}
+		if raw[0] == ' ' || raw[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested values are not supported, use top-level keys", n)
+		}
+		i := strings.IndexAny(line, ":=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		value, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		lines = append(lines, configLine{line: n, key: key, name: configFlagName(key), value: value})
+	}
+	return lines, scanner.Err()
+}
+
+// parseConfigValue unquotes a scalar or flattens an inline list to a
+// comma-separated string
+func parseConfigValue(s string) (string, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return "", errors.New("unterminated list")
+		}
+		var items []string
+		for _, item := range strings.Split(s[1:len(s)-1], ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, err := unquoteConfig(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return unquoteConfig(s)
+}
+
+func unquoteConfig(s string) (string, error) {
+	if len(s) >= 2 {
+		switch {
+		case s[0] == '"' && s[len(s)-1] == '"':
+			return strconv.Unquote(s)
+		case s[0] == '\'' && s[len(s)-1] == '\'':
+			return s[1 : len(s)-1], nil
+		}
+	}
+	return s, nil
+}
+
+// stripComment removes a # comment that is not inside quotes
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// configFlagName maps a file key such as base_url to its flag name
+func configFlagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(key), "_", "-"))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearConfigEnv unsets the environment variables of every setting so the
+// test does not depend on the environment it runs in
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("SHORTENER_CONFIG", "")
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	configFlags(fs, &Config{})
+	fs.VisitAll(func(f *flag.Flag) { t.Setenv(configEnvName(f.Name), "") })
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := "port: 7000\n" +
+		"base_url: https://file.example\n" +
+		"domains: [\"file.example\", \"go.file.example\"]\n" +
+		"code_length: 7\n" +
+		"normalize_tracking_params: utm_*, ref\n"
+
+	tests := []struct {
+		name  string
+		file  bool
+		env   map[string]string
+		args  []string
+		check func(c *Config) bool
+	}{
+		{"default", false, nil, nil, func(c *Config) bool {
+			return c.Port == 8080 && c.BaseURL == "" && c.Domains == nil && c.CodeLength == 6 &&
+				reflect.DeepEqual(c.NormalizeTrackingParams, DefaultTrackingParams)
+		}},
+		{"file over default", true, nil, nil, func(c *Config) bool {
+			return c.Port == 7000 && c.BaseURL == "https://file.example" && c.CodeLength == 7 &&
+				reflect.DeepEqual(c.Domains, []string{"file.example", "go.file.example"}) &&
+				reflect.DeepEqual(c.NormalizeTrackingParams, []string{"utm_*", "ref"})
+		}},
+		{"env over file", true, map[string]string{
+			"PORT":                                "7100",
+			"SHORTENER_BASE_URL":                  "https://env.example",
+			"SHORTENER_DOMAINS":                   "env.example",
+			"SHORTENER_NORMALIZE_TRACKING_PARAMS": "fbclid",
+		}, nil, func(c *Config) bool {
+			return c.Port == 7100 && c.BaseURL == "https://env.example" && c.CodeLength == 7 &&
+				reflect.DeepEqual(c.Domains, []string{"env.example"}) &&
+				reflect.DeepEqual(c.NormalizeTrackingParams, []string{"fbclid"})
+		}},
+		{"flag over env", true, map[string]string{
+			"PORT":              "7100",
+			"SHORTENER_DOMAINS": "env.example",
+		}, []string{"-port", "7200", "-domains", "flag.example,go.flag.example", "-base-url", "https://flag.example"}, func(c *Config) bool {
+			return c.Port == 7200 && c.BaseURL == "https://flag.example" && c.CodeLength == 7 &&
+				reflect.DeepEqual(c.Domains, []string{"flag.example", "go.flag.example"})
+		}},
+		{"empty env is unset", true, map[string]string{"SHORTENER_CODE_LENGTH": ""}, nil, func(c *Config) bool {
+			return c.CodeLength == 7
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			if tt.file {
+				t.Setenv("SHORTENER_CONFIG", writeConfigFile(t, "shortener.yaml", file))
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, _, err := LoadConfig(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("unexpected config %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestConfigPrintRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"defaults", nil},
+		{"lists and strings", []string{
+			"-base-url", "https://sho.rt/s",
+			"-domains", "sho.rt,go.sho.rt",
+			"-normalize-tracking-params", "utm_*,ref,mc_cid",
+			"-normalize-sort-query=false",
+			"-read-timeout", "1m30s",
+			"-log-redirect-sample", "0.25",
+			"-inactive-fallback-url", "https://sho.rt/ended#top",
+			"-trusted-proxies", "10.0.0.0/8, 192.168.1.1",
+		}},
+		{"empty lists", []string{"-normalize-tracking-params", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			want, _, err := LoadConfig(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var printed bytes.Buffer
+			want.Print(&printed)
+
+			path := writeConfigFile(t, "printed.yaml", printed.String())
+			got, _, err := LoadConfig([]string{"-config", path})
+			if err != nil {
+				t.Fatalf("reading printed config: %v\n%s", err, printed.String())
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip changed the config\n got %+v\nwant %+v\n%s", got, want, printed.String())
+			}
+		})
+	}
+}
+
+func TestConfigPrintLists(t *testing.T) {
+	c := &Config{
+		Domains:                 []string{"sho.rt", "go.sho.rt"},
+		NormalizeTrackingParams: []string{"utm_*", "ref"},
+		ReadTimeout:             5 * time.Second,
+	}
+	var printed bytes.Buffer
+	c.Print(&printed)
+	for _, line := range []string{
+		`domains: ["sho.rt", "go.sho.rt"]`,
+		`normalize_tracking_params: ["utm_*", "ref"]`,
+		`allowed_networks: []`,
+		`read_timeout: "5s"`,
+	} {
+		if !strings.Contains(printed.String(), line+"\n") {
+			t.Errorf("printed config lacks %q:\n%s", line, printed.String())
+		}
+	}
+}
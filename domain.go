@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// domainFor returns the Domain of links created on the named short domain.
+// The default domain, the first one configured, is stored as "" and may
+// be named either way. It reports false for domains that are not ours.
+func (h *Handler) domainFor(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	switch {
+	case name == "" || len(h.domains) > 0 && name == h.domains[0]:
+		return "", true
+	case h.isShortDomain(name):
+		return name, true
+	}
+	return "", false
+}
+
+// isShortDomain reports whether host is one of the configured domains
+func (h *Handler) isShortDomain(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range h.domains {
+		if host == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// hostDomain returns the Domain of the links served on the host a request
+// was made to. Hosts other than the configured domains, such as localhost
+// or an internal name, serve the default domain.
+func (h *Handler) hostDomain(r *http.Request) string {
+	_, host := h.origin(r)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	domain, _ := h.domainFor(host)
+	return domain
+}
+
+// isDomainName reports whether s is a plain lowercase host name suitable
+// as a short domain
+func isDomainName(s string) bool {
+	if s == "" || len(s) > 253 || strings.HasPrefix(s, ".") || strings.HasSuffix(s, ".") {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GeoDB maps IP addresses to ISO 3166-1 alpha-2 country codes using a
+// local CSV file, so lookups never leave the process. Each row is one of:
+//
+//	network,country        e.g. 81.2.69.0/24,GB
+//	start,end,country      e.g. 81.2.69.0,81.2.69.255,GB (DB-IP style)
+//	from,to,country,...    decimal IPv4 bounds (IP2Location LITE style)
+//
+// Header rows, blank lines and lines starting with '#' are skipped.
+type GeoDB struct {
+	ranges []geoRange // sorted by start, non-overlapping
+}
+
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// LoadGeoDB reads an IP-to-country CSV file
+func LoadGeoDB(path string) (*GeoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db, err := parseGeoDB(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+func parseGeoDB(r io.Reader) (*GeoDB, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	db := &GeoDB{}
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rng, err := parseGeoRecord(record)
+		if err != nil {
+			// Tolerate a header row
+			if row == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		if rng.country == "" {
+			continue
+		}
+		db.ranges = append(db.ranges, rng)
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].start.Less(db.ranges[j].start)
+	})
+	for i := 1; i < len(db.ranges); i++ {
+		if !db.ranges[i-1].end.Less(db.ranges[i].start) {
+			return nil, fmt.Errorf("overlapping ranges %s and %s", db.ranges[i-1].start, db.ranges[i].start)
+		}
+	}
+	return db, nil
+}
+
+func parseGeoRecord(record []string) (geoRange, error) {
+	switch {
+	case len(record) >= 3:
+		start, err := parseGeoAddr(record[0])
+		if err != nil {
+			break
+		}
+		end, err := parseGeoAddr(record[1])
+		if err != nil {
+			return geoRange{}, err
+		}
+		if end.Less(start) || start.Is4() != end.Is4() {
+			return geoRange{}, fmt.Errorf("invalid range %s-%s", start, end)
+		}
+		return geoRange{start: start, end: end, country: parseCountry(record[2])}, nil
+	case len(record) < 2:
+		return geoRange{}, errors.New("expected network and country")
+	}
+
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+	if err != nil {
+		return geoRange{}, err
+	}
+	prefix = prefix.Masked()
+	return geoRange{start: prefix.Addr().Unmap(), end: lastAddr(prefix).Unmap(), country: parseCountry(record[1])}, nil
+}
+
+// parseGeoAddr accepts an IP address or a decimal IPv4 number
+func parseGeoAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// parseCountry normalizes a country code, returning "" for placeholders
+// such as "-" used for unassigned ranges
+func parseCountry(s string) string {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if !isCountryCode(s) {
+		return ""
+	}
+	return s
+}
+
+func isCountryCode(s string) bool {
+	return len(s) == 2 && s[0] >= 'A' && s[0] <= 'Z' && s[1] >= 'A' && s[1] <= 'Z'
+}
+
+// lastAddr returns the highest address in a prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	bits := prefix.Bits()
+	for i := range b {
+		for bit := 0; bit < 8; bit++ {
+			if i*8+bit >= bits {
+				b[i] |= 0x80 >> bit
+			}
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// Len returns the number of ranges loaded
+func (db *GeoDB) Len() int {
+	return len(db.ranges)
+}
+
+// Lookup returns the country code for an address, or "" if unknown
+func (db *GeoDB) Lookup(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	// Find the last range starting at or before addr
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].start)
+	}) - 1
+	if i < 0 {
+		return ""
+	}
+	rng := db.ranges[i]
+	if rng.end.Less(addr) || rng.start.Is4() != addr.Is4() {
+		return ""
+	}
+	return rng.country
+}
+
+// ClientIPResolver extracts the visitor's address from a request. The
+// X-Forwarded-For header is only honoured when the connection comes
+// from a trusted proxy, and is walked from the right so entries added
+// by the client itself cannot spoof the result.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIPResolver creates a resolver trusting the given proxy
+// networks (CIDRs or single addresses)
+func NewClientIPResolver(trusted []string) (*ClientIPResolver, error) {
+	c := &ClientIPResolver{}
+	for _, entry := range trusted {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			c.trusted = append(c.trusted, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		c.trusted = append(c.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return c, nil
+}
+
+// ClientIP returns the address of the visitor behind any trusted proxies
+func (c *ClientIPResolver) ClientIP(r *http.Request) netip.Addr {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		addr, _ := netip.ParseAddr(r.RemoteAddr)
+		return addr.Unmap()
+	}
+	addr := remote.Addr().Unmap()
+	if c == nil || !c.isTrusted(addr) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !c.isTrusted(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// FromTrustedProxy reports whether the request's connection comes from a
+// trusted proxy, so that its forwarding headers can be believed
+func (c *ClientIPResolver) FromTrustedProxy(r *http.Request) bool {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if c == nil || err != nil {
+		return false
+	}
+	return c.isTrusted(remote.Addr().Unmap())
+}
+
+func (c *ClientIPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
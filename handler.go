@@ -1,31 +1,129 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Handler handles HTTP requests
 type Handler struct {
-	store *URLStore
+	store      *URLStore
+	normalize  NormalizeOptions
+	codeLength int
+
+	// reputation, when set, vets destinations before they are shortened
+	// and, with recheckOnRedirect, again every time a link is followed.
+	reputation        ReputationChecker
+	recheckOnRedirect bool
+
+	// network, when set, rejects destinations on internal networks
+	network *NetworkPolicy
+
+	// baseURL is the canonical public address of this service: short
+	// links are built on it, and destinations on it are recognized as our
+	// own short links. expander, when set, follows links on known
+	// third-party shorteners.
+	baseURL  *url.URL
+	expander *ShortenerExpander
+
+	// trustForwarded takes the scheme and host of requests from the
+	// X-Forwarded-Proto and X-Forwarded-Host headers set by trusted proxies
+	trustForwarded bool
+
+	// domains are the short domains links can be created on. The first is
+	// the default, served on baseURL, whose links have an empty Domain.
+	domains []string
+
+	// attempts throttles password guesses on protected links
+	attempts *attemptLimiter
+
+	// previewAll shows the interstitial preview page for every link
+	previewAll bool
+
+	// inactiveFallback is where links outside their activation window
+	// redirect when they have no fallback of their own
+	inactiveFallback string
+
+	// geo resolves visitor countries for geo rules; clientIPs finds the
+	// visitor address behind trusted proxies
+	geo       *GeoDB
+	clientIPs *ClientIPResolver
+
+	// revealProtected shows the destinations of protected links in API
+	// responses. Only set when the handler serves the local operator, as
+	// the CLI does on a store file.
+	revealProtected bool
+
+	// metrics counts requests and shortens for the /metrics endpoint
+	metrics *Metrics
+
+	// storeFile is checked for writability by /readyz; draining makes
+	// /readyz fail once shutdown has begun
+	storeFile string
+	draining  atomic.Bool
 }
 
 // NewHandler creates a new HTTP handler
 func NewHandler(store *URLStore) *Handler {
-	return &Handler{store: store}
+	return &Handler{
+		store:      store,
+		normalize:  DefaultNormalizeOptions(),
+		codeLength: 6,
+		attempts:   newAttemptLimiter(5, 15*time.Minute),
+		metrics:    NewMetrics(),
+	}
 }
 
 // ShortenRequest represents the request body for shortening a URL
 type ShortenRequest struct {
 	URL        string `json:"url"`
+	Domain     string `json:"domain,omitempty"`
 	CustomCode string `json:"custom_code,omitempty"`
+	Dedupe     string `json:"dedupe,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Preview    bool   `json:"preview,omitempty"`
+
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	FallbackURL string     `json:"fallback_url,omitempty"`
+
+	Rules    []RedirectRule `json:"rules,omitempty"`
+	GeoRules []GeoRule      `json:"geo_rules,omitempty"`
+	Variants []Variant      `json:"variants,omitempty"`
+
+	Languages map[string]string `json:"languages,omitempty"`
 }
 
+// hasOptions reports whether the request asks for per-link behaviour,
+// in which case an existing link for the same URL cannot be reused.
+func (req *ShortenRequest) hasOptions() bool {
+	return req.Password != "" || req.Preview ||
+		req.NotBefore != nil || req.NotAfter != nil || req.FallbackURL != "" ||
+		len(req.Rules) > 0 || len(req.GeoRules) > 0 || len(req.Variants) > 0 ||
+		len(req.Languages) > 0
+}
+
+// Dedupe modes control what happens when the URL was already shortened
+const (
+	DedupeReuse        = "reuse"          // return the existing code (default)
+	DedupeAlwaysNew    = "always-new"     // always create another code
+	DedupeFailIfExists = "fail-if-exists" // reject the request with 409
+)
+
 // ShortenResponse represents the response for a shortened URL
 type ShortenResponse struct {
 	ShortCode   string `json:"short_code"`
+	Domain      string `json:"domain,omitempty"`
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
 }
@@ -50,67 +148,200 @@ func (h *Handler) HandleShorten(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate and normalize URL
-	if !ValidateURL(req.URL) {
-		h.respondError(w, "Invalid URL format. URL must start with http:// or https://", http.StatusBadRequest)
+	plan, err := h.planShorten(r, &req)
+	if err != nil {
+		h.respondShortenError(w, err)
 		return
 	}
-
-	normalized, err := NormalizeURL(req.URL)
+	var mapping *URLMapping
+	h.store.Batch(func(tx *StoreTx) {
+		mapping, _, err = h.commitShorten(tx, plan)
+	})
 	if err != nil {
-		h.respondError(w, "Invalid URL", http.StatusBadRequest)
+		h.respondShortenError(w, err)
 		return
 	}
 
-	// Check if URL already exists (using normalized form)
-	if existingCode, exists := h.store.GetByOriginalURL(normalized); exists {
-		h.respondSuccess(w, existingCode, normalized, r)
-		return
+	h.respondSuccess(w, mapping, r)
+}
+
+// shortenPlan is a validated shorten request, ready to be committed
+type shortenPlan struct {
+	mapping    *URLMapping // everything except the short code, including its domain
+	customCode string
+	mode       string
+	reusable   bool
+}
+
+// requestError is a failed request with the status code to respond with
+type requestError struct {
+	message    string
+	statusCode int
+}
+
+func (e *requestError) Error() string { return e.message }
+
+// planShorten validates a shorten request and prepares its destinations.
+// It does not touch the store's write lock, so slow checks such as DNS
+// lookups and password hashing happen here.
+func (h *Handler) planShorten(r *http.Request, req *ShortenRequest) (*shortenPlan, error) {
+	domain, ok := h.domainFor(req.Domain)
+	if !ok {
+		return nil, &requestError{"Unknown domain " + strconv.Quote(req.Domain), http.StatusBadRequest}
+	}
+
+	// Validate, normalize and vet the URL
+	normalized, err := h.prepareDestination(r, req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.NotBefore != nil && req.NotAfter != nil && !req.NotAfter.After(*req.NotBefore) {
+		return nil, &requestError{"not_after must be later than not_before", http.StatusBadRequest}
+	}
+	var fallbackURL string
+	if req.FallbackURL != "" {
+		if fallbackURL, err = h.prepareDestination(r, req.FallbackURL); err != nil {
+			return nil, &fieldError{"fallback_url", err}
+		}
+	}
+	prepare := h.requestDestinations(r)
+	rules, err := h.prepareRules(prepare, req.Rules)
+	if err != nil {
+		return nil, err
+	}
+	geoRules, err := h.prepareGeoRules(prepare, req.GeoRules)
+	if err != nil {
+		return nil, err
+	}
+	variants, err := h.prepareVariants(prepare, req.Variants)
+	if err != nil {
+		return nil, err
+	}
+	languages, err := h.prepareLanguages(prepare, req.Languages)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := req.Dedupe
+	if mode == "" {
+		mode = DedupeReuse
+	}
+	if mode != DedupeReuse && mode != DedupeAlwaysNew && mode != DedupeFailIfExists {
+		return nil, &requestError{"Invalid dedupe mode. Use reuse, always-new or fail-if-exists", http.StatusBadRequest}
+	}
+
+	if len(req.Password) > maxPasswordLength {
+		return nil, &requestError{fmt.Sprintf("Password must be at most %d characters", maxPasswordLength), http.StatusBadRequest}
+	}
+	if reservedCodes[req.CustomCode] {
+		return nil, &requestError{fmt.Sprintf("Custom code %q is reserved", req.CustomCode), http.StatusBadRequest}
+	}
+	if req.CustomCode != "" && !isValidShortCode(req.CustomCode) {
+		return nil, &requestError{"Invalid custom code. Use only alphanumeric characters", http.StatusBadRequest}
+	}
+
+	mapping := &URLMapping{
+		Domain:      domain,
+		OriginalURL: normalized,
+		Preview:     req.Preview,
+		NotBefore:   req.NotBefore,
+		NotAfter:    req.NotAfter,
+		FallbackURL: fallbackURL,
+		Rules:       rules,
+		GeoRules:    geoRules,
+		Variants:    variants,
+		Languages:   languages,
+	}
+	if req.Password != "" {
+		if mapping.PasswordHash, err = HashPassword(req.Password); err != nil {
+			return nil, &requestError{"Failed to hash password", http.StatusInternalServerError}
+		}
+	}
+
+	return &shortenPlan{
+		mapping:    mapping,
+		customCode: req.CustomCode,
+		mode:       mode,
+		// Links with per-link options are never handed out to other requests
+		reusable: mode == DedupeReuse && !req.hasOptions(),
+	}, nil
+}
+
+// commitShorten finds a reusable link for a plan or saves a new one,
+// reporting whether it was created
+func (h *Handler) commitShorten(tx *StoreTx, plan *shortenPlan) (*URLMapping, bool, error) {
+	normalized, domain := plan.mapping.OriginalURL, plan.mapping.Domain
+
+	// Check if URL already exists on the domain (using normalized form). A
+	// custom code that differs from the existing ones becomes an
+	// additional alias.
+	var aliases []*URLMapping
+	for _, alias := range tx.Aliases(normalized) {
+		if alias.Domain == domain {
+			aliases = append(aliases, alias)
+		}
+	}
+	if len(aliases) > 0 {
+		if plan.mode == DedupeFailIfExists {
+			// Name an alias only if API responses may show it
+			for _, alias := range aliases {
+				if !alias.Protected || h.revealProtected {
+					return nil, false, &requestError{"URL already shortened as " + alias.ShortCode, http.StatusConflict}
+				}
+			}
+			return nil, false, &requestError{"URL already shortened", http.StatusConflict}
+		}
+		for _, alias := range aliases {
+			if plan.reusable && alias.isPlain() && (plan.customCode == "" || plan.customCode == alias.ShortCode) {
+				return alias, false, nil
+			}
+		}
 	}
 
 	// Generate or use custom short code
 	var shortCode string
-	if req.CustomCode != "" {
-		// Validate custom code
-		if !isValidShortCode(req.CustomCode) {
-			h.respondError(w, "Invalid custom code. Use only alphanumeric characters", http.StatusBadRequest)
-			return
-		}
-		if h.store.Exists(req.CustomCode) {
-			h.respondError(w, "Custom code already exists", http.StatusConflict)
-			return
+	if plan.customCode != "" {
+		if mapping, err := tx.Get(linkKey(domain, plan.customCode)); err == nil {
+			// Asking again for an alias that already points here is not a conflict
+			if plan.reusable && mapping.isPlain() && mapping.OriginalURL == normalized {
+				return mapping, false, nil
+			}
+			return nil, false, &requestError{"Custom code already exists", http.StatusConflict}
 		}
-		shortCode = req.CustomCode
+		shortCode = plan.customCode
 	} else {
 		// Generate short code with collision handling
 		maxAttempts := 10
 		for i := 0; i < maxAttempts; i++ {
-			shortCode = GenerateShortCode(req.URL, 6)
-			if !h.store.Exists(shortCode) {
+			shortCode = GenerateShortCode(normalized, h.codeLength)
+			if !tx.Exists(linkKey(domain, shortCode)) {
 				break
 			}
+			h.metrics.codeCollisions.Add(1)
 			if i == maxAttempts-1 {
-				h.respondError(w, "Failed to generate unique short code", http.StatusInternalServerError)
-				return
+				h.metrics.codeGenerationFailures.Add(1)
+				return nil, false, &requestError{"Failed to generate unique short code", http.StatusInternalServerError}
 			}
 		}
 	}
 
-	// Save the mapping (store normalized URL)
-	if err := h.store.Save(shortCode, normalized); err != nil {
-		h.respondError(w, err.Error(), http.StatusInternalServerError)
-		return
+	mapping := plan.mapping.clone()
+	mapping.ShortCode = shortCode
+	if err := tx.Save(mapping); err != nil {
+		return nil, false, &requestError{err.Error(), http.StatusInternalServerError}
 	}
-
-	h.respondSuccess(w, shortCode, normalized, r)
+	return mapping.clone(), true, nil
 }
 
-// HandleRedirect handles GET requests to redirect short URLs
+// HandleRedirect handles GET requests to redirect short URLs, and the
+// password form POST for protected links
 func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
 		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	start := time.Now()
 
 	// Extract short code from path
 	shortCode := strings.TrimPrefix(r.URL.Path, "/")
@@ -122,7 +353,7 @@ func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 	// }
 	if shortCode == "" || strings.HasPrefix(shortCode, "api/") || shortCode == "shorten" {
 		// If root path, serve the modular UI. Otherwise return 404 for api/ or shorten path collisions.
-		if shortCode == "" {
+		if shortCode == "" && r.Method == http.MethodGet {
 			ServeUI(w)
 			return
 		}
@@ -130,51 +361,740 @@ func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get original URL
-	mapping, err := h.store.Get(shortCode)
+	// A trailing "+" (as on bit.ly) asks for the preview page instead
+	forcePreview := false
+	if code, ok := strings.CutSuffix(shortCode, "+"); ok && r.Method == http.MethodGet {
+		shortCode, forcePreview = code, true
+	}
+	// Codes are never stored in any other form, and the lookup key must
+	// not be forged from the path, as in /other.domain/code
+	if !isExistingShortCode(shortCode) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Get original URL, looking the code up on the domain of the host
+	mapping, err := h.store.Get(linkKey(h.hostDomain(r), shortCode))
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
+	logRedirect(r, mapping.ShortCode)
+	defer func() { h.metrics.redirectLatency.observe(time.Since(start)) }()
+
+	// Check the activation window first, so neither the preview nor the
+	// password form reveal a link before it goes live
+	if now := time.Now(); mapping.notYetActive(now) || mapping.expired(now) {
+		h.serveInactive(w, r, mapping, now)
+		return
+	}
+	if forcePreview {
+		if !h.recheckReputation(w, mapping.OriginalURL) {
+			return
+		}
+		ServePreview(w, mapping, mapping.OriginalURL, false)
+		return
+	}
+	if mapping.PasswordHash != "" {
+		h.handleProtected(w, r, mapping)
+		return
+	}
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decision := h.selectDestination(mapping, r)
+	if !h.recheckReputation(w, decision.URL) {
+		return
+	}
+
+	h.recordClick(w, r, mapping, decision)
+
+	if h.previewAll || mapping.Preview {
+		ServePreview(w, mapping, decision.URL, true)
+		return
+	}
+
+	// Redirect to the chosen destination. Every link can still get rules or
+	// be deleted, and browsers never come back for a cached redirect, so
+	// the redirect is temporary and not stored.
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, decision.URL, http.StatusFound)
+}
+
+// serveInactive handles a visit outside the link's activation window by
+// redirecting to the link's (or the global) fallback URL, or rendering a
+// "not available" page: 404 before the window opens, 410 after it closes.
+func (h *Handler) serveInactive(w http.ResponseWriter, r *http.Request, mapping *URLMapping, now time.Time) {
+	fallback := mapping.FallbackURL
+	if fallback == "" {
+		fallback = h.inactiveFallback
+	}
+	if fallback != "" {
+		if !h.recheckReputation(w, fallback) {
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, fallback, http.StatusFound)
+		return
+	}
+
+	if mapping.notYetActive(now) {
+		ServeUnavailable(w, "This link is not yet available",
+			"It will go live on "+mapping.NotBefore.UTC().Format("January 2, 2006 at 15:04 MST")+".",
+			http.StatusNotFound)
+		return
+	}
+	ServeUnavailable(w, "This link is no longer available",
+		"It expired on "+mapping.NotAfter.UTC().Format("January 2, 2006 at 15:04 MST")+".",
+		http.StatusGone)
+}
+
+// handleProtected serves the password prompt for a protected link and
+// redirects once the correct password is posted
+func (h *Handler) handleProtected(w http.ResponseWriter, r *http.Request, mapping *URLMapping) {
+	if r.Method == http.MethodGet {
+		ServePasswordPrompt(w, mapping.ShortCode, "", http.StatusOK)
+		return
+	}
+
+	if ok, retryAfter := h.attempts.attempt(mapping.key()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		ServePasswordPrompt(w, mapping.ShortCode, "Too many attempts. Please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+	if !CheckPassword(mapping.PasswordHash, r.PostFormValue("password")) {
+		ServePasswordPrompt(w, mapping.ShortCode, "Incorrect password", http.StatusUnauthorized)
+		return
+	}
+	h.attempts.reset(mapping.key())
+
+	decision := h.selectDestination(mapping, r)
+	if !h.recheckReputation(w, decision.URL) {
+		return
+	}
+
+	h.recordClick(w, r, mapping, decision)
+	http.Redirect(w, r, decision.URL, http.StatusSeeOther)
+}
 
-	// Increment click counter
-	h.store.IncrementClicks(shortCode)
+// recordClick counts a visit, keeps A/B visitors on their variant and
+// adds which rule chose the destination to the access log. Visits to
+// links without rules log no rule.
+func (h *Handler) recordClick(w http.ResponseWriter, r *http.Request, mapping *URLMapping, decision redirectDecision) {
+	h.store.RecordClick(mapping.key(), decision.Variant)
+	if decision.Variant >= 0 {
+		setVariantCookie(w, mapping, decision.Variant)
+	}
+
+	rule := decision.Rule
+	if rule == "" {
+		if len(mapping.Rules) == 0 && len(mapping.GeoRules) == 0 && len(mapping.Languages) == 0 {
+			return
+		}
+		rule = "default"
+	}
+	logAttrs(r, slog.String("rule", rule), slog.String("destination", decision.URL))
+}
 
-	// Redirect to original URL
-	http.Redirect(w, r, mapping.OriginalURL, http.StatusMovedPermanently)
+// ListedURL is a mapping together with its public short link
+type ListedURL struct {
+	*URLMapping
+	ShortURL string `json:"short_url"`
+}
+
+// listed pairs a mapping with its short link
+func (h *Handler) listed(r *http.Request, mapping *URLMapping) ListedURL {
+	return ListedURL{h.visible(mapping), h.shortURL(r, mapping.Domain, mapping.ShortCode)}
+}
+
+// visible returns the mapping as API responses may show it: protected
+// links are redacted unless revealProtected is set
+func (h *Handler) visible(mapping *URLMapping) *URLMapping {
+	if h.revealProtected {
+		return mapping
+	}
+	return mapping.redacted()
 }
 
-// HandleListURLs handles GET requests to list all URLs
+// HandleListURLs handles GET requests to list all URLs, or with the
+// domain query parameter those of one short domain
 func (h *Handler) HandleListURLs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	filter, hasFilter := r.URL.Query()["domain"]
+	var domain string
+	if hasFilter {
+		var ok bool
+		if domain, ok = h.domainFor(filter[0]); !ok {
+			h.respondError(w, "Unknown domain", http.StatusBadRequest)
+			return
+		}
+	}
 
-	mappings := h.store.GetAll()
+	urls := []ListedURL{}
+	for _, mapping := range h.store.GetAll() {
+		if !hasFilter || mapping.Domain == domain {
+			urls = append(urls, h.listed(r, mapping))
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"count": len(mappings),
-		"urls":  mappings,
+		"count": len(urls),
+		"urls":  urls,
 	})
 }
 
-// respondSuccess sends a successful response
-func (h *Handler) respondSuccess(w http.ResponseWriter, shortCode, originalURL string, r *http.Request) {
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+// HandleURL handles requests for a single short code under
+// /api/urls/{code} and its sub-resources. Codes on other than the default
+// domain are addressed with the domain query parameter.
+func (h *Handler) HandleURL(w http.ResponseWriter, r *http.Request) {
+	shortCode, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/urls/"), "/")
+	if shortCode == "" {
+		h.respondError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	domain, ok := h.domainFor(r.URL.Query().Get("domain"))
+	if !ok {
+		h.respondError(w, "Unknown domain", http.StatusBadRequest)
+		return
+	}
+	key := linkKey(domain, shortCode)
+	logAttrs(r, slog.String("code", shortCode))
+
+	switch resource {
+	case "":
+	case "rules":
+		h.handleRules(w, r, key)
+		return
+	case "qr":
+		h.handleQR(w, r, key)
+		return
+	default:
+		h.respondError(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		mapping, err := h.store.Get(key)
+		if err != nil {
+			h.respondError(w, "Short code not found", http.StatusNotFound)
+			return
+		}
+		h.respondJSON(w, http.StatusOK, h.listed(r, mapping))
+	case http.MethodDelete:
+		if err := h.store.Delete(key); err != nil {
+			h.respondError(w, "Short code not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RulesRequest represents the redirect rules and variants of a link. In a
+// PUT, omitted fields are left unchanged and empty values remove them.
+type RulesRequest struct {
+	Rules     *[]RedirectRule    `json:"rules,omitempty"`
+	GeoRules  *[]GeoRule         `json:"geo_rules,omitempty"`
+	Variants  *[]Variant         `json:"variants,omitempty"`
+	Languages *map[string]string `json:"languages,omitempty"`
+}
+
+// handleRules shows (GET) or replaces (PUT) the redirect rules and
+// variants of the link with the given store key
+func (h *Handler) handleRules(w http.ResponseWriter, r *http.Request, key string) {
+	switch r.Method {
+	case http.MethodGet:
+		mapping, err := h.store.Get(key)
+		if err != nil {
+			h.respondError(w, "Short code not found", http.StatusNotFound)
+			return
+		}
+		mapping = h.visible(mapping)
+		rules, geoRules, variants := mapping.Rules, mapping.GeoRules, mapping.Variants
+		if rules == nil {
+			rules = []RedirectRule{}
+		}
+		if geoRules == nil {
+			geoRules = []GeoRule{}
+		}
+		if variants == nil {
+			variants = []Variant{}
+		}
+		languages := mapping.Languages
+		if languages == nil {
+			languages = map[string]string{}
+		}
+		h.respondJSON(w, http.StatusOK, RulesRequest{Rules: &rules, GeoRules: &geoRules, Variants: &variants, Languages: &languages})
+	case http.MethodPut:
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		var req RulesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !h.store.Exists(key) {
+			h.respondError(w, "Short code not found", http.StatusNotFound)
+			return
+		}
+		prepare := h.requestDestinations(r)
+		var rules []RedirectRule
+		var geoRules []GeoRule
+		var variants []Variant
+		var languages map[string]string
+		var err error
+		if req.Rules != nil {
+			if rules, err = h.prepareRules(prepare, *req.Rules); err != nil {
+				h.respondDestinationError(w, err)
+				return
+			}
+		}
+		if req.GeoRules != nil {
+			if geoRules, err = h.prepareGeoRules(prepare, *req.GeoRules); err != nil {
+				h.respondDestinationError(w, err)
+				return
+			}
+		}
+		if req.Variants != nil {
+			if variants, err = h.prepareVariants(prepare, *req.Variants); err != nil {
+				h.respondDestinationError(w, err)
+				return
+			}
+		}
+		if req.Languages != nil {
+			if languages, err = h.prepareLanguages(prepare, *req.Languages); err != nil {
+				h.respondDestinationError(w, err)
+				return
+			}
+		}
+		mapping, err := h.store.Update(key, func(m *URLMapping) error {
+			if req.Rules != nil {
+				m.Rules = rules
+			}
+			if req.GeoRules != nil {
+				m.GeoRules = geoRules
+			}
+			if req.Variants != nil {
+				carryVariantClicks(variants, m.Variants)
+				m.Variants = variants
+			}
+			if req.Languages != nil {
+				m.Languages = languages
+			}
+			return nil
+		})
+		if err != nil {
+			h.respondError(w, "Short code not found", http.StatusNotFound)
+			return
+		}
+		h.respondJSON(w, http.StatusOK, h.listed(r, mapping))
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// QR code rendering limits
+const (
+	qrDefaultSize   = 256
+	qrMinSize       = 64
+	qrMaxSize       = 2048
+	qrDefaultMargin = 4
+	qrMaxMargin     = 16
+)
+
+// handleQR serves a QR code of a link's short URL as PNG or SVG. The size
+// (pixels), ec (L, M, Q or H) and margin (modules) query parameters
+// control the rendering.
+func (h *Handler) handleQR(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mapping, err := h.store.Get(key)
+	if err != nil {
+		h.respondError(w, "Short code not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	size, err := queryInt(query, "size", qrDefaultSize)
+	if err != nil || size < qrMinSize || size > qrMaxSize {
+		h.respondError(w, fmt.Sprintf("Size must be between %d and %d", qrMinSize, qrMaxSize), http.StatusBadRequest)
+		return
+	}
+	margin, err := queryInt(query, "margin", qrDefaultMargin)
+	if err != nil || margin < 0 || margin > qrMaxMargin {
+		h.respondError(w, fmt.Sprintf("Margin must be between 0 and %d", qrMaxMargin), http.StatusBadRequest)
+		return
+	}
+	level := QRLevelM
+	if ec := query.Get("ec"); ec != "" {
+		var ok bool
+		if level, ok = ParseQRLevel(ec); !ok {
+			h.respondError(w, "Error correction level (ec) must be L, M, Q or H", http.StatusBadRequest)
+			return
+		}
+	}
+
+	code, err := EncodeQR([]byte(h.shortURL(r, mapping.Domain, mapping.ShortCode)), level)
+	if err != nil {
+		h.respondError(w, "Failed to encode QR code", http.StatusInternalServerError)
+		return
+	}
+
+	var body []byte
+	switch format := query.Get("format"); format {
+	case "", "png":
+		if body, err = code.PNG(size, margin); err != nil {
+			h.respondError(w, "Failed to render QR code", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+	case "svg":
+		body = code.SVG(size, margin)
+		w.Header().Set("Content-Type", "image/svg+xml")
+	default:
+		h.respondError(w, "Format must be png or svg", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(body)
+}
+
+// queryInt parses an integer query parameter, returning def if it is absent
+func queryInt(query url.Values, name string, def int) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// DestinationResponse lists every alias pointing at one destination
+type DestinationResponse struct {
+	OriginalURL string        `json:"original_url"`
+	Count       int           `json:"count"`
+	Clicks      int           `json:"clicks"`
+	Aliases     []*URLMapping `json:"aliases"`
+}
+
+// HandleDestinations handles GET requests listing the aliases of a URL
+func (h *Handler) HandleDestinations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rawURL := r.URL.Query().Get("url")
+	if !ValidateURL(rawURL) {
+		h.respondError(w, "Invalid URL format. URL must start with http:// or https://", http.StatusBadRequest)
+		return
+	}
+	normalized, err := NormalizeURLWithOptions(rawURL, h.normalize.destination())
+	if err != nil {
+		h.respondError(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	// Protected links are left out, as listing them would tell where they go
+	response := DestinationResponse{OriginalURL: normalized, Aliases: []*URLMapping{}}
+	for _, mapping := range h.store.Aliases(normalized) {
+		if mapping.Protected && !h.revealProtected {
+			continue
+		}
+		response.Aliases = append(response.Aliases, mapping)
+		response.Clicks += mapping.Clicks
+	}
+	response.Count = len(response.Aliases)
+
+	h.respondJSON(w, http.StatusOK, response)
+}
+
+// statsTopLinks is how many of the most clicked links /api/stats returns
+const statsTopLinks = 10
+
+// StatsResponse summarizes the links in the store
+type StatsResponse struct {
+	URLs         int           `json:"urls"`
+	Clicks       int           `json:"clicks"`
+	Destinations int           `json:"destinations"`
+	Protected    int           `json:"protected"`
+	TopLinks     []*URLMapping `json:"top_links"`
+}
+
+// HandleStats handles GET requests for link and click totals
+func (h *Handler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mappings := h.store.GetAll()
+	response := StatsResponse{URLs: len(mappings)}
+	destinations := make(map[string]struct{})
+	for _, mapping := range mappings {
+		response.Clicks += mapping.Clicks
+		destinations[mapping.OriginalURL] = struct{}{}
+		if mapping.Protected {
+			response.Protected++
+		}
+	}
+	response.Destinations = len(destinations)
+
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].Clicks != mappings[j].Clicks {
+			return mappings[i].Clicks > mappings[j].Clicks
+		}
+		return mappings[i].ShortCode < mappings[j].ShortCode
+	})
+	if len(mappings) > statsTopLinks {
+		mappings = mappings[:statsTopLinks]
+	}
+	for i, mapping := range mappings {
+		mappings[i] = h.visible(mapping)
+	}
+	response.TopLinks = mappings
+
+	h.respondJSON(w, http.StatusOK, response)
+}
+
+// checkDestination vets a normalized destination against the configured
+// reputation checker and network policy.
+func (h *Handler) checkDestination(ctx context.Context, destination string) error {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return err
+	}
+	if err := h.checkReputationURL(u); err != nil {
+		return err
+	}
+	return h.checkNetworkURL(ctx, u)
+}
+
+// recheckReputation re-runs the reputation check before a link sends a
+// visitor anywhere (redirect, preview or fallback), if configured, and
+// writes an error response if the destination is now rejected
+func (h *Handler) recheckReputation(w http.ResponseWriter, destination string) bool {
+	if !h.recheckOnRedirect {
+		return true
+	}
+	u, err := url.Parse(destination)
+	if err != nil {
+		return true
+	}
+	if err := h.checkReputationURL(u); err != nil {
+		h.respondDestinationError(w, err)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) checkReputationURL(u *url.URL) error {
+	if h.reputation == nil {
+		return nil
+	}
+	return h.reputation.Check(u)
+}
+
+func (h *Handler) checkNetworkURL(ctx context.Context, u *url.URL) error {
+	if h.network == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	return h.network.Check(ctx, u)
+}
+
+// ErrInvalidURL is returned for destinations that are not absolute http(s) URLs
+var ErrInvalidURL = errors.New("invalid URL")
+
+// prepareDestination validates, normalizes and vets a destination URL,
+// returning the form that should be stored
+func (h *Handler) prepareDestination(r *http.Request, rawURL string) (string, error) {
+	if !ValidateURL(rawURL) {
+		return "", ErrInvalidURL
+	}
+	normalized, err := NormalizeURLWithOptions(rawURL, h.normalize.destination())
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+
+	// Store the final target rather than a chain of short links
+	if normalized, err = h.resolveChain(r, normalized); err != nil {
+		return "", err
+	}
+	if err := h.checkDestination(r.Context(), normalized); err != nil {
+		return "", err
+	}
+	return normalized, nil
+}
+
+// destinationFunc prepares one destination URL, returning the form that
+// should be stored
+type destinationFunc func(rawURL string) (string, error)
+
+// requestDestinations prepares destinations of a shorten or edit request
+// with prepareDestination
+func (h *Handler) requestDestinations(r *http.Request) destinationFunc {
+	return func(rawURL string) (string, error) {
+		return h.prepareDestination(r, rawURL)
+	}
+}
+
+// fieldError ties an error to the request field that caused it
+type fieldError struct {
+	field string
+	err   error
+}
+
+func (e *fieldError) Error() string { return e.field + ": " + e.err.Error() }
+func (e *fieldError) Unwrap() error { return e.err }
+
+// respondShortenError responds to an error from planning or committing a
+// shorten request
+func (h *Handler) respondShortenError(w http.ResponseWriter, err error) {
+	message, statusCode := shortenErrorStatus(err)
+	h.respondError(w, message, statusCode)
+}
+
+// shortenErrorStatus returns the message and status code for an error from
+// planning or committing a shorten request
+func shortenErrorStatus(err error) (string, int) {
+	var re *requestError
+	if errors.As(err, &re) {
+		return re.message, re.statusCode
+	}
+	return destinationErrorStatus(err)
+}
+
+// respondDestinationError maps errors from preparing a destination to a
+// response, naming the request field if it is not the main URL.
+func (h *Handler) respondDestinationError(w http.ResponseWriter, err error) {
+	message, statusCode := destinationErrorStatus(err)
+	h.respondError(w, message, statusCode)
+}
+
+// destinationErrorStatus returns the message and status code for an
+// error from preparing a destination. Unexpected errors are treated as
+// upstream failures.
+func destinationErrorStatus(err error) (string, int) {
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		message, statusCode := destinationErrorStatus(fe.err)
+		return "Invalid " + fe.field + ": " + message, statusCode
+	}
+
+	switch {
+	case errors.Is(err, ErrUnknownPlatform):
+		return "Unknown platform. Use ios, android, windows, macos, linux, mobile or desktop", http.StatusBadRequest
+	case errors.Is(err, ErrInvalidCountry):
+		return "Countries must be ISO 3166-1 alpha-2 codes such as US or DE", http.StatusBadRequest
+	case errors.Is(err, ErrInvalidLanguage):
+		return "Languages must be keyed by tags such as en, de or pt-BR", http.StatusBadRequest
+	case errors.Is(err, ErrInvalidVariants):
+		return fmt.Sprintf("Variants need at least two destinations with weights from 1 to %d", maxVariantWeight), http.StatusBadRequest
+	case errors.Is(err, ErrTooManyRules):
+		return fmt.Sprintf("At most %d rules are allowed", maxRedirectRules), http.StatusBadRequest
+	case errors.Is(err, ErrInvalidURL):
+		return "Invalid URL format. URL must start with http:// or https://", http.StatusBadRequest
+	case errors.Is(err, ErrDestinationBlocked):
+		return "Destination blocked", http.StatusForbidden
+	case errors.Is(err, ErrDestinationNotAllowed):
+		return "Destination address not allowed", http.StatusForbidden
+	case errors.Is(err, ErrDestinationUnresolvable):
+		return "Destination host could not be resolved", http.StatusBadRequest
+	case errors.Is(err, ErrRedirectLoop):
+		return "Destination forms a redirect loop", http.StatusBadRequest
+	case errors.Is(err, ErrRedirectChainTooLong):
+		return "Destination redirect chain is too long", http.StatusBadRequest
+	case errors.Is(err, ErrUnknownShortLink):
+		return "Destination is an unknown short link", http.StatusBadRequest
+	case errors.Is(err, ErrConditionalShortLink):
+		return "Destination is a short link with a password, preview, schedule or rules", http.StatusBadRequest
+	default:
+		return "Failed to check destination", http.StatusBadGateway
+	}
+}
+
+// shortURL returns the public link for a short code on a domain. Links on
+// the default domain are under the configured base URL, or else on the
+// first configured domain or the host r was made to. Other domains use
+// the same scheme.
+func (h *Handler) shortURL(r *http.Request, domain, shortCode string) string {
+	if h.baseURL != nil && domain == "" {
+		return strings.TrimRight(h.baseURL.String(), "/") + "/" + shortCode
+	}
+	scheme, host := h.origin(r)
+	if h.baseURL != nil {
+		scheme = h.baseURL.Scheme
+	}
+	if domain == "" && len(h.domains) > 0 {
+		domain = h.domains[0]
+	}
+	if domain != "" {
+		host = domain
 	}
-	host := r.Host
 	if host == "" {
 		host = "localhost:8080"
 	}
+	return fmt.Sprintf("%s://%s/%s", scheme, host, shortCode)
+}
 
+// origin returns the scheme and host a request was made to. Behind a
+// trusted proxy, and only if trustForwarded is set, they are taken from
+// the X-Forwarded-Proto and X-Forwarded-Host headers.
+func (h *Handler) origin(r *http.Request) (scheme, host string) {
+	scheme, host = "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !h.trustForwarded || !h.clientIPs.FromTrustedProxy(r) {
+		return scheme, host
+	}
+
+	if proto := strings.ToLower(lastForwarded(r.Header, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	if fwdHost := lastForwarded(r.Header, "X-Forwarded-Host"); fwdHost != "" {
+		// Only plain host[:port] values; anything else is ignored
+		if u, err := url.Parse("//" + fwdHost); err == nil && u.Host == fwdHost && u.User == nil {
+			host = fwdHost
+		}
+	}
+	return scheme, host
+}
+
+// lastForwarded returns the last value of a comma-separated forwarding
+// header, which is the one set by the nearest proxy
+func lastForwarded(header http.Header, name string) string {
+	values := header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	last := values[len(values)-1]
+	if i := strings.LastIndexByte(last, ','); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.TrimSpace(last)
+}
+
+// respondSuccess sends a successful response
+func (h *Handler) respondSuccess(w http.ResponseWriter, mapping *URLMapping, r *http.Request) {
+	logAttrs(r, slog.String("code", mapping.ShortCode))
 	response := ShortenResponse{
-		ShortCode:   shortCode,
-		ShortURL:    fmt.Sprintf("%s://%s/%s", scheme, host, shortCode),
-		OriginalURL: originalURL,
+		ShortCode:   mapping.ShortCode,
+		Domain:      mapping.Domain,
+		ShortURL:    h.shortURL(r, mapping.Domain, mapping.ShortCode),
+		OriginalURL: mapping.OriginalURL,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -182,6 +1102,13 @@ func (h *Handler) respondSuccess(w http.ResponseWriter, shortCode, originalURL s
 	json.NewEncoder(w).Encode(response)
 }
 
+// respondJSON sends a JSON response with the given status code
+func (h *Handler) respondJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
 // respondError sends an error response
 func (h *Handler) respondError(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
@@ -189,9 +1116,20 @@ func (h *Handler) respondError(w http.ResponseWriter, message string, statusCode
 	json.NewEncoder(w).Encode(ErrorResponse{Error: message})
 }
 
+// reservedCodes are paths the server handles itself, so links cannot
+// use them as codes
+var reservedCodes = map[string]bool{"shorten": true, "metrics": true, "healthz": true, "readyz": true}
+
 // isValidShortCode validates a custom short code
 func isValidShortCode(code string) bool {
-	if len(code) < 3 || len(code) > 20 {
+	return len(code) >= 3 && isExistingShortCode(code)
+}
+
+// isExistingShortCode validates a code that may already be in use, such
+// as one looked up or imported. Other services hand out codes as short as
+// one character (YOURLS starts at "1"), so only new codes need three.
+func isExistingShortCode(code string) bool {
+	if len(code) < 1 || len(code) > 20 || reservedCodes[code] {
 		return false
 	}
 
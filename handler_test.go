@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedirectActivationWindow(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	now := time.Now()
+	later, earlier := now.Add(time.Hour), now.Add(-time.Hour)
+	links := []*URLMapping{
+		{ShortCode: "launch", OriginalURL: "https://8.8.8.8/launch-plans", NotBefore: &later},
+		{ShortCode: "ended", OriginalURL: "https://8.8.8.8/old-plans", NotAfter: &earlier},
+		{ShortCode: "live", OriginalURL: "https://8.8.8.8/live-plans", NotBefore: &earlier, NotAfter: &later},
+	}
+	for _, m := range links {
+		if err := h.store.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		hidden     string // must not appear in the body or Location
+	}{
+		{"/launch", http.StatusNotFound, "launch-plans"},
+		{"/launch+", http.StatusNotFound, "launch-plans"},
+		{"/ended", http.StatusGone, "old-plans"},
+		{"/ended+", http.StatusGone, "old-plans"},
+		{"/live", http.StatusFound, ""},
+		{"/live+", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		w := httptest.NewRecorder()
+		h.HandleRedirect(w, r)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("GET %s: status %d, want %d", tt.path, w.Code, tt.wantStatus)
+		}
+		if tt.hidden == "" {
+			continue
+		}
+		if strings.Contains(w.Body.String(), tt.hidden) || strings.Contains(w.Header().Get("Location"), tt.hidden) {
+			t.Errorf("GET %s: response reveals the destination before its window", tt.path)
+		}
+	}
+}
+
+func TestRedirectRejectsInvalidCodes(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	h.domains = []string{"team.io", "go.team.io", "s.team.io"}
+	links := []*URLMapping{
+		{ShortCode: "abc", Domain: "s.team.io", OriginalURL: "https://8.8.8.8/other-domain"},
+		{ShortCode: "abc", Domain: "go.team.io", OriginalURL: "https://8.8.8.8/this-domain"},
+	}
+	for _, m := range links {
+		if err := h.store.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		target     string
+		wantStatus int
+	}{
+		{"http://go.team.io/abc", http.StatusFound},
+		{"http://go.team.io/s.team.io/abc", http.StatusNotFound},
+		{"http://go.team.io/s.team.io/abc+", http.StatusNotFound},
+		{"http://team.io/s.team.io/abc", http.StatusNotFound},
+		{"http://go.team.io/ab", http.StatusNotFound},
+		{"http://go.team.io/a%20bc", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		w := httptest.NewRecorder()
+		h.HandleRedirect(w, r)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("GET %s: status %d, want %d", tt.target, w.Code, tt.wantStatus)
+		}
+		if strings.Contains(w.Header().Get("Location"), "other-domain") {
+			t.Errorf("GET %s: redirected to a link of another domain", tt.target)
+		}
+	}
+}
+
+func TestRedirectNotCached(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	if err := h.store.Save(&URLMapping{ShortCode: "plain1", OriginalURL: "https://8.8.8.8/first"}); err != nil {
+		t.Fatal(err)
+	}
+	redirect := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.HandleRedirect(w, httptest.NewRequest(http.MethodGet, "/plain1", nil))
+		return w
+	}
+
+	w := redirect()
+	if w.Code != http.StatusFound || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("plain link: status %d, Cache-Control %q, want 302 no-store", w.Code, w.Header().Get("Cache-Control"))
+	}
+
+	// Rules added later must reach visitors on their next click
+	if _, err := h.store.Update("plain1", func(m *URLMapping) error {
+		m.Rules = []RedirectRule{{Platform: PlatformIOS, URL: "https://8.8.8.8/ios"}}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/plain1", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)")
+	w = httptest.NewRecorder()
+	h.HandleRedirect(w, r)
+	if location := w.Header().Get("Location"); location != "https://8.8.8.8/ios" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("edited link: Location %q, Cache-Control %q", location, w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestRedirectRechecksBlockedDestinations(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	earlier, later := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	links := []*URLMapping{
+		{ShortCode: "bad1", OriginalURL: "https://evil.example/phish"},
+		{ShortCode: "ended1", OriginalURL: "https://8.8.8.8/sale", NotAfter: &earlier, FallbackURL: "https://evil.example/sale"},
+		{ShortCode: "ended2", OriginalURL: "https://8.8.8.8/sale", NotAfter: &earlier, FallbackURL: "https://8.8.8.8/over"},
+		{ShortCode: "launch1", OriginalURL: "https://8.8.8.8/launch", NotBefore: &later},
+	}
+	for _, m := range links {
+		if err := h.store.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The destinations were fine when the links were created
+	h.inactiveFallback = "https://evil.example/soon"
+	h.reputation = blockedHost("evil.example")
+
+	tests := []struct {
+		path       string
+		recheck    bool
+		wantStatus int
+	}{
+		{"/bad1", false, http.StatusFound},
+		{"/bad1+", false, http.StatusOK},
+		{"/bad1", true, http.StatusForbidden},
+		{"/bad1+", true, http.StatusForbidden},
+		{"/ended1", true, http.StatusForbidden},
+		{"/ended2", true, http.StatusFound},
+		{"/launch1", true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		h.recheckOnRedirect = tt.recheck
+		w := httptest.NewRecorder()
+		h.HandleRedirect(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("GET %s (recheck %v): status %d, want %d", tt.path, tt.recheck, w.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusForbidden && strings.Contains(w.Body.String(), "evil.example") {
+			t.Errorf("GET %s: blocked response links to the destination: %s", tt.path, w.Body)
+		}
+	}
+}
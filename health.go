@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// version is the build version, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// healthCheckTimeout bounds how long a probe waits for the store lock
+const healthCheckTimeout = time.Second
+
+// HealthResponse is the body of /healthz and /readyz
+type HealthResponse struct {
+	Status  string            `json:"status"` // "ok" or "unavailable"
+	Version string            `json:"version"`
+	Checks  map[string]string `json:"checks"` // "ok" or what failed
+}
+
+// HandleHealth reports whether the server is alive: the store answers
+// within healthCheckTimeout. Meant for liveness probes.
+func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	h.respondHealth(w, r, map[string]string{"store": h.checkStore()})
+}
+
+// HandleReady reports whether the server should get traffic: it is alive,
+// the store file (if any) can be written, and it is not shutting down.
+// Meant for readiness probes.
+func (h *Handler) HandleReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"store": h.checkStore()}
+	if h.storeFile != "" {
+		checks["store_file"] = "ok"
+		if err := checkWritable(h.storeFile); err != nil {
+			checks["store_file"] = err.Error()
+		}
+	}
+	checks["shutdown"] = "ok"
+	if h.draining.Load() {
+		checks["shutdown"] = "shutting down"
+	}
+	h.respondHealth(w, r, checks)
+}
+
+func (h *Handler) checkStore() string {
+	if !h.store.Available(healthCheckTimeout) {
+		return "store lock not acquired within " + healthCheckTimeout.String()
+	}
+	return "ok"
+}
+
+func (h *Handler) respondHealth(w http.ResponseWriter, r *http.Request, checks map[string]string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	response := HealthResponse{Status: "ok", Version: version, Checks: checks}
+	for _, result := range checks {
+		if result != "ok" {
+			response.Status = "unavailable"
+		}
+	}
+	if response.Status != "ok" {
+		h.respondJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import formats of other shortener services, accepted by POST /api/import
+const (
+	FormatBitly  = "bitly"
+	FormatYOURLS = "yourls"
+)
+
+// foreignLayout lists the column or field names another service uses for
+// each part of a link, in order of preference. Names are compared after
+// normalizeFieldName.
+type foreignLayout struct {
+	code    []string
+	url     []string
+	created []string
+	clicks  []string
+}
+
+// bitlyLayout covers the CSV download from the Bitly dashboard and the
+// links returned by the v4 API
+var bitlyLayout = foreignLayout{
+	code:    []string{"link", "bitlink", "short_link", "short_url", "id"},
+	url:     []string{"long_url", "destination", "original_url", "url"},
+	created: []string{"created_at", "date_created", "created", "creation_date"},
+	clicks:  []string{"total_clicks", "clicks", "user_clicks", "total_engagements", "engagements"},
+}
+
+// yourlsLayout covers the yourls_url table layout used by YOURLS export
+// plugins and the links returned by its stats API
+var yourlsLayout = foreignLayout{
+	code:    []string{"keyword", "shorturl", "short_url"},
+	url:     []string{"url", "long_url"},
+	created: []string{"timestamp", "created_at", "date"},
+	clicks:  []string{"clicks"},
+}
+
+// foreignTimeLayouts are the date formats seen in other services' exports.
+// Dates without a zone are taken as UTC.
+var foreignTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700", // Bitly API
+	"2006-01-02 15:04:05",      // YOURLS
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"1/2/2006 15:04:05",
+	"1/2/2006 15:04",
+	"1/2/2006",
+}
+
+// parseForeign reads another service's CSV or JSON export, detected from
+// the first character of the body
+func parseForeign(r io.Reader, layout foreignLayout) ([]importRecord, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if first == '[' || first == '{' {
+		return parseForeignJSON(br, layout)
+	}
+	return parseForeignCSV(br, layout)
+}
+
+func parseForeignCSV(r io.Reader, layout foreignLayout) ([]importRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		// Spreadsheet exports often start with a byte order mark
+		name = strings.TrimPrefix(name, "\ufeff")
+		if _, dup := columns[normalizeFieldName(name)]; !dup {
+			columns[normalizeFieldName(name)] = i
+		}
+	}
+	if !hasField(columns, layout.code) || !hasField(columns, layout.url) {
+		return nil, errors.New("missing short link or destination column")
+	}
+
+	var records []importRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		mapping, err := foreignRecord(layout, func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		})
+		records = append(records, importRecord{mapping: mapping, err: err})
+	}
+}
+
+// parseForeignJSON reads an array of link objects, or an object holding
+// them under "links" either as an array (Bitly) or keyed by position
+// (YOURLS, e.g. "link_1")
+func parseForeignJSON(r io.Reader, layout foreignLayout) ([]importRecord, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var body interface{}
+	if err := dec.Decode(&body); err != nil {
+		return nil, err
+	}
+
+	var items []interface{}
+	if obj, ok := body.(map[string]interface{}); ok {
+		body = obj["links"]
+	}
+	switch links := body.(type) {
+	case []interface{}:
+		items = links
+	case map[string]interface{}:
+		keys := make([]string, 0, len(links))
+		for key := range links {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return naturalLess(keys[i], keys[j]) })
+		for _, key := range keys {
+			items = append(items, links[key])
+		}
+	default:
+		return nil, errors.New("expected an array of links or an object with \"links\"")
+	}
+
+	records := make([]importRecord, len(items))
+	for i, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			records[i].err = errors.New("link is not an object")
+			continue
+		}
+		fields := make(map[string]string, len(obj))
+		for key, value := range obj {
+			switch v := value.(type) {
+			case string:
+				fields[normalizeFieldName(key)] = strings.TrimSpace(v)
+			case json.Number:
+				fields[normalizeFieldName(key)] = v.String()
+			}
+		}
+		records[i].mapping, records[i].err = foreignRecord(layout, func(name string) string {
+			return fields[name]
+		})
+	}
+	return records, nil
+}
+
+// foreignRecord builds a mapping from the fields of one exported link
+func foreignRecord(layout foreignLayout, field func(string) string) (*URLMapping, error) {
+	lookup := func(names []string) string {
+		for _, name := range names {
+			if v := field(name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	m := &URLMapping{
+		ShortCode:   shortCodeFromLink(lookup(layout.code)),
+		OriginalURL: lookup(layout.url),
+	}
+	if m.ShortCode == "" {
+		return nil, errors.New("missing short link")
+	}
+	if v := lookup(layout.created); v != "" {
+		created, err := parseForeignTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid creation date %q", v)
+		}
+		m.CreatedAt = created
+	}
+	if v := lookup(layout.clicks); v != "" {
+		clicks, err := strconv.Atoi(strings.ReplaceAll(v, ",", ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid clicks %q", v)
+		}
+		m.Clicks = clicks
+	}
+	return m, nil
+}
+
+// shortCodeFromLink returns the code of a short link given as a bare
+// keyword, "bit.ly/abc" or a full URL
+func shortCodeFromLink(link string) string {
+	link, _, _ = strings.Cut(link, "?")
+	link = strings.TrimRight(link, "/")
+	if i := strings.LastIndexByte(link, '/'); i >= 0 {
+		link = link[i+1:]
+	}
+	return link
+}
+
+func parseForeignTime(s string) (time.Time, error) {
+	// Unix timestamps
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), nil
+	}
+	for _, layout := range foreignTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("unrecognized date")
+}
+
+// normalizeFieldName folds "Total Clicks", "total-clicks" and
+// "total_clicks" to the same name
+func normalizeFieldName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+func hasField(columns map[string]int, names []string) bool {
+	for _, name := range names {
+		if _, ok := columns[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// naturalLess orders keys like "link_2" before "link_10"
+func naturalLess(a, b string) bool {
+	ai := strings.TrimLeft(a, "abcdefghijklmnopqrstuvwxyz_")
+	bi := strings.TrimLeft(b, "abcdefghijklmnopqrstuvwxyz_")
+	an, aerr := strconv.Atoi(ai)
+	bn, berr := strconv.Atoi(bi)
+	if aerr == nil && berr == nil && a[:len(a)-len(ai)] == b[:len(b)-len(bi)] {
+		return an < bn
+	}
+	return a < b
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestImportYOURLSShortKeywords(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	body := "keyword,url,title,timestamp,ip,clicks\n" +
+		"1,https://8.8.8.8/one,One,2012-03-04 05:06:07,127.0.0.1,12\n" +
+		"ab,https://8.8.8.8/ab,Ab,2012-03-04 05:06:08,127.0.0.1,3\n" +
+		"abc,https://8.8.8.8/abc,Abc,2012-03-04 05:06:09,127.0.0.1,0\n" +
+		"a.b,https://8.8.8.8/dot,Dot,2012-03-04 05:06:10,127.0.0.1,0\n"
+	report, code := postImport(t, h, "format=yourls", body)
+	if code != http.StatusOK || report.Created != 3 || report.Invalid != 1 {
+		t.Fatalf("status %d, report %+v, want 3 created and a.b invalid", code, report)
+	}
+	m, err := h.store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Clicks != 12 || m.CreatedAt.Format("2006-01-02 15:04:05") != "2012-03-04 05:06:07" {
+		t.Errorf("imported 1 with %d clicks created %v", m.Clicks, m.CreatedAt)
+	}
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		location   string
+	}{
+		{"/1", http.StatusFound, "https://8.8.8.8/one"},
+		{"/ab", http.StatusFound, "https://8.8.8.8/ab"},
+		{"/abc", http.StatusFound, "https://8.8.8.8/abc"},
+		{"/2", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.HandleRedirect(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.wantStatus || w.Header().Get("Location") != tt.location {
+			t.Errorf("GET %s: %d %q, want %d %q", tt.path, w.Code, w.Header().Get("Location"), tt.wantStatus, tt.location)
+		}
+	}
+}
+
+func TestShortCodeValidators(t *testing.T) {
+	tests := []struct {
+		code             string
+		custom, existing bool
+	}{
+		{"1", false, true},
+		{"ab", false, true},
+		{"abc", true, true},
+		{"my-link_2", true, true},
+		{"", false, false},
+		{"a/b", false, false},
+		{"a.b", false, false},
+		{"shorten", false, false},
+		{"abcdefghijklmnopqrstu", false, false},
+	}
+	for _, tt := range tests {
+		if got := isValidShortCode(tt.code); got != tt.custom {
+			t.Errorf("isValidShortCode(%q) = %v, want %v", tt.code, got, tt.custom)
+		}
+		if got := isExistingShortCode(tt.code); got != tt.existing {
+			t.Errorf("isExistingShortCode(%q) = %v, want %v", tt.code, got, tt.existing)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidLanguage is returned for language variants with a malformed tag
+var ErrInvalidLanguage = errors.New("invalid language tag")
+
+// languagePreference is one entry of an Accept-Language header
+type languagePreference struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage returns the acceptable languages of a header in
+// order of preference. Tags with q=0, invalid tags and "*" are dropped.
+func parseAcceptLanguage(header string) []languagePreference {
+	var prefs []languagePreference
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !isLanguageTag(tag) {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(name) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		if q > 0 {
+			prefs = append(prefs, languagePreference{tag: tag, q: q})
+		}
+	}
+	// Equal weights keep the order the client listed them in
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	return prefs
+}
+
+// matchLanguage picks the link language that best serves the visitor.
+// For each preference in turn it tries an exact match, then the tag with
+// subtags removed ("de-AT" -> "de"), then any variant of the same base
+// language ("de" -> "de-DE"). It returns "" if nothing matches.
+func matchLanguage(header string, languages map[string]string) string {
+	if len(languages) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(languages))
+	for tag := range languages {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	for _, pref := range parseAcceptLanguage(header) {
+		for tag := pref.tag; tag != ""; {
+			if _, ok := languages[tag]; ok {
+				return tag
+			}
+			i := strings.LastIndexByte(tag, '-')
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+		base, _, _ := strings.Cut(pref.tag, "-")
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, base+"-") {
+				return tag
+			}
+		}
+	}
+	return ""
+}
+
+// isLanguageTag reports whether s looks like a lowercase BCP 47 tag:
+// hyphen-separated alphanumeric subtags of up to 8 characters, starting
+// with a 2-8 letter language.
+func isLanguageTag(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, sub := range strings.Split(s, "-") {
+		if len(sub) == 0 || len(sub) > 8 {
+			return false
+		}
+		for _, c := range sub {
+			letter := c >= 'a' && c <= 'z'
+			if !letter && (i == 0 || c < '0' || c > '9') {
+				return false
+			}
+		}
+		if i == 0 && len(sub) < 2 {
+			return false
+		}
+	}
+	return true
+}
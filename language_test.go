@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestMatchLanguage(t *testing.T) {
+	languages := map[string]string{
+		"de":    "https://8.8.8.8/de",
+		"en-gb": "https://8.8.8.8/en-gb",
+		"en-us": "https://8.8.8.8/en-us",
+		"fr-ca": "https://8.8.8.8/fr-ca",
+		"pt-br": "https://8.8.8.8/pt-br",
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"exact", "en-GB", "en-gb"},
+		{"first listed wins on equal q", "pt-BR, de", "pt-br"},
+		{"highest q wins", "de;q=0.5, en-US;q=0.9", "en-us"},
+		{"q among other params", "de;q=0.4;level=1, fr-CA;level=1;q=0.8", "fr-ca"},
+		{"q=0 excludes", "en-US;q=0, de;q=0.1", "de"},
+		{"q=0.0 excludes", "pt-BR;q=0.0", ""},
+		{"invalid q excludes", "en-US;q=2, fr-CA;q=abc, de;q=0.2", "de"},
+		{"region falls back to base", "de-AT", "de"},
+		{"script and region fall back to base", "de-Latn-CH", "de"},
+		{"base matches a region", "fr", "fr-ca"},
+		{"base picks the first region in tag order", "en", "en-gb"},
+		{"higher q base beats lower q exact", "es, en-US;q=0.8, en;q=0.9", "en-gb"},
+		{"wildcard matches nothing", "*", ""},
+		{"wildcard is skipped", "*, de;q=0.5", "de"},
+		{"no match", "ja, ko;q=0.8", ""},
+		{"empty header", "", ""},
+		{"malformed tags are skipped", "e, 1de, en_US, de", "de"},
+	}
+	for _, tt := range tests {
+		if got := matchLanguage(tt.header, languages); got != tt.want {
+			t.Errorf("%s: matchLanguage(%q) = %q, want %q", tt.name, tt.header, got, tt.want)
+		}
+	}
+
+	if got := matchLanguage("de", nil); got != "" {
+		t.Errorf("matchLanguage without languages = %q", got)
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []languagePreference
+	}{
+		{"de-DE,de;q=0.9,en;q=0.8", []languagePreference{{"de-de", 1}, {"de", 0.9}, {"en", 0.8}}},
+		{"en;q=0.5, fr, *;q=0.1", []languagePreference{{"fr", 1}, {"en", 0.5}}},
+		{"en;q=0, fr;q=-1, de;q=1.5", nil},
+		{" nl ; q = 0.7 ", []languagePreference{{"nl", 0.7}}},
+	}
+	for _, tt := range tests {
+		got := parseAcceptLanguage(tt.header)
+		if len(got) != len(tt.want) {
+			t.Errorf("parseAcceptLanguage(%q) = %v, want %v", tt.header, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseAcceptLanguage(%q) = %v, want %v", tt.header, got, tt.want)
+				break
+			}
+		}
+	}
+}
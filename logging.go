@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newLogger creates the server logger writing JSON or text records of at
+// least the given level ("debug", "info", "warn" or "error")
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return slog.New(slog.NewJSONHandler(w, opts)), nil
+}
+
+// fatal logs an error and exits, like log.Fatal for the structured logger
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestLog collects what handlers add to the access log entry of a
+// request
+type requestLog struct {
+	id       string
+	redirect bool // a followed short link, subject to sampling
+	attrs    []slog.Attr
+}
+
+type requestLogKey struct{}
+
+// logAttrs adds attributes to the access log entry of r
+func logAttrs(r *http.Request, attrs ...slog.Attr) {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		rl.attrs = append(rl.attrs, attrs...)
+	}
+}
+
+// logRedirect marks r as a followed short link, whose successful access
+// log entries are sampled
+func logRedirect(r *http.Request, code string) {
+	if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		rl.redirect = true
+		rl.attrs = append(rl.attrs, slog.String("code", code))
+	}
+}
+
+// maxRequestIDLength bounds X-Request-ID values taken from proxies
+const maxRequestIDLength = 128
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isRequestID reports whether s is a usable forwarded request ID: short
+// and free of spaces and control characters
+func isRequestID(s string) bool {
+	if s == "" || len(s) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// withAccessLog logs every request with its ID, method, path, status,
+// size and latency, plus what handlers add with logAttrs. The request ID
+// is taken from X-Request-ID when a trusted proxy sets it, else generated,
+// and returned in the X-Request-ID response header. Only the redirectSample
+// fraction (0 to 1) of successful redirects is logged.
+func withAccessLog(next http.Handler, logger *slog.Logger, clientIPs *ClientIPResolver, redirectSample float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := &requestLog{id: r.Header.Get("X-Request-ID")}
+		if !isRequestID(rl.id) || !clientIPs.FromTrustedProxy(r) {
+			rl.id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", rl.id)
+
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		if !logger.Enabled(r.Context(), level) {
+			return
+		}
+		sampled := rl.redirect && rec.status < 400 && redirectSample < 1
+		if sampled && mathrand.Float64() >= redirectSample {
+			return
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", rl.id),
+			slog.String("method", r.Method),
+			slog.String("host", r.Host),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client", clientIPs.ClientIP(r).String()),
+		}
+		attrs = append(attrs, rl.attrs...)
+		if sampled {
+			attrs = append(attrs, slog.Float64("sample_rate", redirectSample))
+		}
+		logger.LogAttrs(r.Context(), level, "Request", attrs...)
+	})
+}
+
+// accessRecorder captures the status and size of a response
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (a *accessRecorder) WriteHeader(code int) {
+	if a.status == 0 {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessRecorder) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(p)
+	a.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (a *accessRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
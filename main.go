@@ -2,48 +2,259 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
 
 func main() {
-	store := NewURLStore()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	os.Exit(serve(nil))
+}
+
+// newMux registers the service's routes for a handler
+func newMux(handler *Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler.HandleRedirect)
+	mux.HandleFunc("/shorten", handler.HandleShorten)
+	mux.HandleFunc("/api/shorten/batch", handler.HandleBatchShorten)
+	mux.HandleFunc("/api/urls", handler.HandleListURLs)
+	mux.HandleFunc("/api/urls/", handler.HandleURL)
+	mux.HandleFunc("/api/destinations", handler.HandleDestinations)
+	mux.HandleFunc("/api/export", handler.HandleExport)
+	mux.HandleFunc("/api/import", handler.HandleImport)
+	mux.HandleFunc("/api/stats", handler.HandleStats)
+	mux.HandleFunc("/metrics", handler.HandleMetrics)
+	mux.HandleFunc("/healthz", handler.HandleHealth)
+	mux.HandleFunc("/readyz", handler.HandleReady)
+	return mux
+}
+
+// newConfiguredHandler creates a handler for store with the settings of
+// cfg, loading the files they name. The blocklist is returned for reloads.
+func newConfiguredHandler(cfg *Config, store *URLStore) (*Handler, *Blocklist, error) {
 	handler := NewHandler(store)
+	handler.codeLength = cfg.CodeLength
+	handler.normalize = NormalizeOptions{
+		SortQuery:       cfg.NormalizeSortQuery,
+		StripTracking:   cfg.NormalizeStripTracking,
+		TrackingParams:  cfg.NormalizeTrackingParams,
+		IDNHost:         cfg.NormalizeIDNHost,
+		PercentEncoding: cfg.NormalizePercentEncoding,
+		DotSegments:     cfg.NormalizeDotSegments,
+		StripFragment:   cfg.NormalizeStripFragment,
+	}
+	normalize := handler.normalize
+	store.SetAliasKey(func(originalURL string) string {
+		return CanonicalURL(originalURL, normalize)
+	})
+	handler.domains = cfg.Domains
+	handler.storeFile = cfg.StoreFile
+
+	// Refuse internal destinations unless explicitly allowed
+	var err error
+	if handler.network, err = NewNetworkPolicy(net.DefaultResolver, cfg.AllowedNetworks); err != nil {
+		return nil, nil, fmt.Errorf("network policy: %v", err)
+	}
+
+	// Public base URL, used to detect destinations that are our own links
+	if cfg.BaseURL != "" {
+		if handler.baseURL, err = url.Parse(cfg.BaseURL); err != nil {
+			return nil, nil, fmt.Errorf("base URL: %v", err)
+		}
+	}
+	if cfg.ExpandShorteners {
+		handler.expander = NewShortenerExpander(NewRedirectlessClient(), DefaultShortenerDomains)
+	}
+
+	handler.previewAll = cfg.PreviewAll
+	handler.inactiveFallback = cfg.InactiveFallbackURL
+
+	// Visitor addresses are taken from X-Forwarded-For only behind these proxies
+	if handler.clientIPs, err = NewClientIPResolver(cfg.TrustedProxies); err != nil {
+		return nil, nil, fmt.Errorf("trusted proxies: %v", err)
+	}
+	handler.trustForwarded = cfg.TrustForwarded
+	if cfg.GeoIPFile != "" {
+		if handler.geo, err = LoadGeoDB(cfg.GeoIPFile); err != nil {
+			return nil, nil, fmt.Errorf("load geoip database: %v", err)
+		}
+	}
+
+	// Optional destination blocklist
+	var blocklist *Blocklist
+	if cfg.BlocklistFile != "" {
+		if blocklist, err = LoadBlocklist(cfg.BlocklistFile); err != nil {
+			return nil, nil, fmt.Errorf("load blocklist: %v", err)
+		}
+		handler.reputation = blocklist
+		handler.recheckOnRedirect = cfg.BlocklistRecheck
+	}
+	return handler, blocklist, nil
+}
+
+// serve runs the HTTP server until it receives SIGINT or SIGTERM. args are
+// the configuration flags; see LoadConfig.
+func serve(args []string) int {
+	cfg, printConfig, err := LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return 2
+	}
+	if printConfig {
+		cfg.Print(os.Stdout)
+		return 0
+	}
 
-	http.HandleFunc("/", handler.HandleRedirect)
-	http.HandleFunc("/shorten", handler.HandleShorten)
-	http.HandleFunc("/api/urls", handler.HandleListURLs)
+	// Structured logs; log package output goes through the same logger
+	logger, err := newLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return 2
+	}
+	slog.SetDefault(logger)
 
-	// Use PORT environment variable when provided (Cloud Run sets this)
-	envPort := os.Getenv("PORT")
-	if envPort == "" {
-		envPort = "8080"
+	// Links are kept in memory unless a store file is configured
+	store := NewURLStore()
+	var persister *Persister
+	if cfg.StoreFile != "" {
+		if store, err = LoadStoreFile(cfg.StoreFile); err != nil {
+			fatal("Loading store failed", "file", cfg.StoreFile, "err", err)
+		}
+		persister = NewPersister(store, cfg.StoreFile, cfg.SaveInterval)
+		slog.Info("Loaded store", "file", cfg.StoreFile, "urls", store.Count())
 	}
-	addr := ":" + envPort
 
-	fmt.Printf("URL Shortener running on http://localhost:%s\n", envPort)
+	handler, blocklist, err := newConfiguredHandler(cfg, store)
+	if err != nil {
+		fatal("Configuring handler failed", "err", err)
+	}
+	if handler.geo != nil {
+		slog.Info("Loaded GeoIP database", "file", cfg.GeoIPFile, "ranges", handler.geo.Len())
+	}
+	if blocklist != nil {
+		slog.Info("Loaded blocklist", "file", cfg.BlocklistFile, "entries", blocklist.Len())
+	}
+
+	var certs *CertReloader
+	if cfg.TLSCertFile != "" {
+		if certs, err = NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			fatal("Loading certificate failed", "file", cfg.TLSCertFile, "err", err)
+		}
+	}
+
+	scheme := "http"
+	if certs != nil {
+		scheme = "https"
+	}
+	fmt.Printf("URL Shortener %s running on %s://localhost:%d\n", version, scheme, cfg.Port)
 	fmt.Println("Endpoints:")
 	fmt.Println("  POST /shorten - Create a short URL")
+	fmt.Println("  POST /api/shorten/batch - Create many short URLs")
 	fmt.Println("  GET  /{code}  - Redirect to original URL")
 	fmt.Println("  GET  /api/urls - List all URLs")
+	fmt.Println("  GET  /api/urls/{code} - Show a short URL")
+	fmt.Println("  DELETE /api/urls/{code} - Delete a short URL")
+	fmt.Println("  GET  /api/destinations?url= - List aliases of a URL")
+	fmt.Println("  GET  /api/export - Export all URLs as JSON or CSV")
+	fmt.Println("  POST /api/import - Import URLs from an export")
+	fmt.Println("  GET  /api/stats - Show link and click totals")
+	fmt.Println("  GET  /metrics - Prometheus metrics")
+	fmt.Println("  GET  /healthz, /readyz - Liveness and readiness")
 
+	root := withMetrics(newMux(handler), handler.metrics)
+	if certs != nil && cfg.HSTSMaxAge > 0 {
+		root = withHSTS(root, cfg.HSTSMaxAge, cfg.HSTSIncludeSubdomains)
+	}
+	root = withAccessLog(root, logger, handler.clientIPs, cfg.LogRedirectSample)
+	errorLog := slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
 	srv := &http.Server{
-		Addr:         addr,
-		Handler:      nil,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		Addr:         ":" + strconv.Itoa(cfg.Port),
+		Handler:      root,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		ErrorLog:     errorLog,
 	}
+	servers := []*http.Server{srv}
 
 	// Start server
+	if certs != nil {
+		srv.TLSConfig = newTLSConfig(certs)
+		go func() {
+			if err := srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				fatal("Listening failed", "err", err)
+			}
+		}()
+	} else {
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("Listening failed", "err", err)
+			}
+		}()
+	}
+
+	if cfg.HTTPRedirectPort != 0 {
+		redirectSrv := &http.Server{
+			Addr:         ":" + strconv.Itoa(cfg.HTTPRedirectPort),
+			Handler:      httpsRedirect(cfg.Port),
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+			ErrorLog:     errorLog,
+		}
+		servers = append(servers, redirectSrv)
+		fmt.Printf("Redirecting http://localhost:%d to HTTPS\n", cfg.HTTPRedirectPort)
+		go func() {
+			if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("Listening failed", "err", err)
+			}
+		}()
+	}
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	if persister != nil {
+		go persister.Run(bgCtx)
+	}
+	if certs != nil {
+		go certs.Watch(bgCtx, cfg.TLSReloadInterval)
+	}
+
+	// Reload the blocklist and certificate on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+		for range hup {
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					slog.Warn("Certificate reload failed, keeping previous certificate", "err", err)
+				} else {
+					slog.Info("Reloaded certificate", "file", cfg.TLSCertFile)
+				}
+			}
+			if blocklist == nil {
+				continue
+			}
+			if err := blocklist.Reload(); err != nil {
+				slog.Warn("Blocklist reload failed, keeping previous list", "err", err)
+				continue
+			}
+			slog.Info("Reloaded blocklist", "entries", blocklist.Len())
 		}
 	}()
 
@@ -51,13 +262,32 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
+
+	// Fail readiness first so load balancers stop sending new requests
+	handler.draining.Store(true)
+	time.Sleep(cfg.ShutdownDelay)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// A failed shutdown still saves the store, since requests that did
+	// complete may have changed it
+	code := 0
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			slog.Error("Server forced to shutdown", "err", err)
+			s.Close()
+			code = 1
+		}
+	}
+	stopBackground()
+	if persister != nil {
+		if err := persister.Flush(); err != nil {
+			slog.Error("Saving store failed", "file", cfg.StoreFile, "err", err)
+			code = 1
+		}
 	}
 
-	log.Println("Server exiting")
+	slog.Info("Server exiting")
+	return code
 }
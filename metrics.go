@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bucket upper bounds, in seconds
+var (
+	redirectBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+	lockWaitBuckets = []float64{.000001, .00001, .0001, .001, .01, .1, 1}
+)
+
+// histogram counts durations in buckets, like a Prometheus histogram
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // per bucket, the last one for larger values
+	sum    atomic.Int64    // nanoseconds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// observe records one duration
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// write writes the histogram's samples, adding labels (such as
+// `mode="read"`) to each of them
+func (h *histogram) write(w io.Writer, name, labels string) {
+	bucketLabels, totalLabels := "", ""
+	if labels != "" {
+		bucketLabels, totalLabels = labels+",", "{"+labels+"}"
+	}
+
+	var count uint64
+	for i := range h.counts {
+		count += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, bucketLabels, le, count)
+	}
+	sum := time.Duration(h.sum.Load()).Seconds()
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, totalLabels, strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, totalLabels, count)
+}
+
+// Metrics counts what the server does, for the /metrics endpoint. Store
+// figures come from the store itself.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[routeStatus]uint64
+
+	redirectLatency *histogram
+
+	// Generated codes that were already taken, each followed by a retry
+	// unless the attempts ran out, and shortens that ran out of attempts
+	codeCollisions         atomic.Uint64
+	codeGenerationFailures atomic.Uint64
+}
+
+type routeStatus struct {
+	route  string
+	status int
+}
+
+// NewMetrics creates empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:        make(map[routeStatus]uint64),
+		redirectLatency: newHistogram(redirectBuckets),
+	}
+}
+
+// withMetrics counts the requests served by mux by route pattern and
+// status
+func withMetrics(mux *http.ServeMux, m *Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, route := mux.Handler(r)
+		if route == "" {
+			route = "none" // redirects to a cleaned path
+		}
+		rec := &accessRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		m.mu.Lock()
+		m.requests[routeStatus{route, rec.status}]++
+		m.mu.Unlock()
+	})
+}
+
+// HandleMetrics serves the metrics in the Prometheus text format
+func (h *Handler) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := h.metrics
+
+	m.mu.Lock()
+	requests := make([]routeStatus, 0, len(m.requests))
+	counts := make(map[routeStatus]uint64, len(m.requests))
+	for key, n := range m.requests {
+		requests = append(requests, key)
+		counts[key] = n
+	}
+	m.mu.Unlock()
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].route != requests[j].route {
+			return requests[i].route < requests[j].route
+		}
+		return requests[i].status < requests[j].status
+	})
+
+	fmt.Fprintln(w, "# HELP shortener_http_requests_total HTTP requests by route pattern and status.")
+	fmt.Fprintln(w, "# TYPE shortener_http_requests_total counter")
+	for _, key := range requests {
+		fmt.Fprintf(w, "shortener_http_requests_total{route=%q,status=\"%d\"} %d\n", key.route, key.status, counts[key])
+	}
+
+	fmt.Fprintln(w, "# HELP shortener_redirect_duration_seconds Time to serve requests for existing short links.")
+	fmt.Fprintln(w, "# TYPE shortener_redirect_duration_seconds histogram")
+	m.redirectLatency.write(w, "shortener_redirect_duration_seconds", "")
+
+	fmt.Fprintln(w, "# HELP shortener_code_collisions_total Generated short codes that were already taken.")
+	fmt.Fprintln(w, "# TYPE shortener_code_collisions_total counter")
+	fmt.Fprintf(w, "shortener_code_collisions_total %d\n", m.codeCollisions.Load())
+	fmt.Fprintln(w, "# HELP shortener_code_generation_failures_total Shorten requests that found no free code within the retry limit.")
+	fmt.Fprintln(w, "# TYPE shortener_code_generation_failures_total counter")
+	fmt.Fprintf(w, "shortener_code_generation_failures_total %d\n", m.codeGenerationFailures.Load())
+
+	fmt.Fprintln(w, "# HELP shortener_store_mappings Short links in the store.")
+	fmt.Fprintln(w, "# TYPE shortener_store_mappings gauge")
+	fmt.Fprintf(w, "shortener_store_mappings %d\n", h.store.Count())
+
+	fmt.Fprintln(w, "# HELP shortener_store_lock_wait_seconds Time spent waiting for the store lock.")
+	fmt.Fprintln(w, "# TYPE shortener_store_lock_wait_seconds histogram")
+	h.store.readWait.write(w, "shortener_store_lock_wait_seconds", `mode="read"`)
+	h.store.writeWait.write(w, "shortener_store_lock_wait_seconds", `mode="write"`)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+var (
+	// ErrDestinationNotAllowed is returned for destinations on internal networks
+	ErrDestinationNotAllowed = errors.New("destination address not allowed")
+	// ErrDestinationUnresolvable is returned when a destination host has no addresses
+	ErrDestinationUnresolvable = errors.New("destination host could not be resolved")
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver satisfies it,
+// and tests can substitute a fake to run offline.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Ranges that are not covered by the netip.Addr classification helpers
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, also Alibaba Cloud metadata
+}
+
+// Hostnames that reach cloud instance metadata services without DNS
+var metadataHosts = map[string]bool{
+	"metadata":                   true,
+	"metadata.google.internal":   true,
+	"instance-data":              true,
+	"instance-data.ec2.internal": true,
+}
+
+// NetworkPolicy guards against server-side request forgery by rejecting
+// destinations that resolve to loopback, link-local, private (RFC 1918,
+// RFC 4193) or cloud metadata addresses. Allowed networks and hosts
+// override the checks for internal deployments.
+type NetworkPolicy struct {
+	resolver   Resolver
+	allowNets  []netip.Prefix
+	allowHosts []string // exact names, or ".suffix" for a whole domain
+}
+
+// NewNetworkPolicy creates a policy using resolver for host lookups.
+// Each allow entry is a CIDR, an IP address, a hostname or a ".domain"
+// suffix.
+func NewNetworkPolicy(resolver Resolver, allow []string) (*NetworkPolicy, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	p := &NetworkPolicy{resolver: resolver}
+	for _, entry := range allow {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			p.allowNets = append(p.allowNets, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			p.allowNets = append(p.allowNets, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		if strings.ContainsAny(entry, "/:") {
+			return nil, fmt.Errorf("invalid allowlist entry %q", entry)
+		}
+		p.allowHosts = append(p.allowHosts, entry)
+	}
+	return p, nil
+}
+
+// Check resolves the destination host and rejects internal addresses
+func (p *NetworkPolicy) Check(ctx context.Context, u *url.URL) error {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if p.hostAllowed(host) {
+		return nil
+	}
+	if metadataHosts[host] || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrDestinationNotAllowed
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddr(addr)
+	}
+
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("%w: %s", ErrDestinationUnresolvable, host)
+	}
+	// Every address must be acceptable, otherwise DNS round-robin could
+	// still route a request inside
+	for _, ipAddr := range addrs {
+		addr, ok := netip.AddrFromSlice(ipAddr.IP)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrDestinationUnresolvable, host)
+		}
+		if err := p.checkAddr(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *NetworkPolicy) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range p.allowNets {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+
+	if addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsPrivate() || addr.IsUnspecified() || addr.IsMulticast() {
+		return ErrDestinationNotAllowed
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return ErrDestinationNotAllowed
+		}
+	}
+	return nil
+}
+
+func (p *NetworkPolicy) hostAllowed(host string) bool {
+	for _, allowed := range p.allowHosts {
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
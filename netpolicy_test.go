@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+// fakeResolver answers lookups from a fixed table, so tests run offline
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := f[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var result []net.IPAddr
+	for _, addr := range addrs {
+		result = append(result, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return result, nil
+}
+
+func TestNetworkPolicyCheck(t *testing.T) {
+	resolver := fakeResolver{
+		"public.example":   {"93.184.216.34"},
+		"internal.example": {"10.1.2.3"},
+		"mixed.example":    {"93.184.216.34", "192.168.0.1"},
+		"v6.example":       {"2606:2800:220:1::1"},
+		"ula.example":      {"fd00::1"},
+		"wiki.corp":        {"10.20.0.5"},
+		"docs.intranet":    {"10.30.0.1"},
+	}
+	policy, err := NewNetworkPolicy(resolver, []string{"10.20.0.0/16", "172.16.5.5", ".intranet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"https://public.example/", nil},
+		{"https://v6.example/", nil},
+		{"https://8.8.8.8/", nil},
+		{"https://internal.example/", ErrDestinationNotAllowed},
+		{"https://mixed.example/", ErrDestinationNotAllowed},
+		{"https://ula.example/", ErrDestinationNotAllowed},
+		{"http://127.0.0.1:8080/", ErrDestinationNotAllowed},
+		{"http://[::1]/", ErrDestinationNotAllowed},
+		{"http://[::ffff:127.0.0.1]/", ErrDestinationNotAllowed},
+		{"http://169.254.169.254/latest/meta-data/", ErrDestinationNotAllowed},
+		{"http://100.100.100.200/", ErrDestinationNotAllowed},
+		{"http://0.0.0.0/", ErrDestinationNotAllowed},
+		{"http://localhost/", ErrDestinationNotAllowed},
+		{"http://app.localhost./", ErrDestinationNotAllowed},
+		{"http://metadata.google.internal/", ErrDestinationNotAllowed},
+		{"https://unknown.example/", ErrDestinationUnresolvable},
+		// Allowed networks, addresses and domains
+		{"https://wiki.corp/", nil},
+		{"http://10.20.1.1/", nil},
+		{"http://172.16.5.5/", nil},
+		{"http://172.16.5.6/", ErrDestinationNotAllowed},
+		{"https://docs.intranet/", nil},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = policy.Check(context.Background(), u)
+		if tt.want == nil && err != nil {
+			t.Errorf("Check(%s) = %v, want allowed", tt.url, err)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("Check(%s) = %v, want %v", tt.url, err, tt.want)
+		}
+	}
+}
+
+func TestNewNetworkPolicyInvalidEntry(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33", "http://wiki.corp", "wiki.corp:8080"} {
+		if _, err := NewNetworkPolicy(fakeResolver{}, []string{entry}); err == nil {
+			t.Errorf("NewNetworkPolicy accepted %q", entry)
+		}
+	}
+}
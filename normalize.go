@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// NormalizeOptions controls the canonicalization steps NormalizeURL
+// applies on top of the basic host, port and trailing slash cleanup.
+// SortQuery, StripTracking and StripFragment only shape the key used to
+// find existing links for a URL; stored destinations keep their query
+// order, tracking parameters and fragment (see destination).
+type NormalizeOptions struct {
+	SortQuery       bool     // order query parameters by key
+	StripTracking   bool     // drop parameters listed in TrackingParams
+	TrackingParams  []string // parameter names; a trailing '*' matches a prefix
+	IDNHost         bool     // convert internationalized hosts to punycode
+	PercentEncoding bool     // decode unreserved escapes, uppercase the rest
+	DotSegments     bool     // resolve "." and ".." path segments
+	StripFragment   bool     // drop the #fragment entirely
+}
+
+// destination returns the options for the stored form of a destination:
+// the steps that keep the page the same for the server, without those
+// that change what the destination sees
+func (o NormalizeOptions) destination() NormalizeOptions {
+	o.SortQuery, o.StripTracking, o.StripFragment = false, false, false
+	return o
+}
+
+// DefaultTrackingParams lists query parameters that only carry campaign
+// or click attribution and never change the destination page.
+var DefaultTrackingParams = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"gbraid",
+	"wbraid",
+	"msclkid",
+	"mc_cid",
+	"mc_eid",
+	"igshid",
+	"yclid",
+	"_hsenc",
+	"_hsmi",
+	"mkt_tok",
+}
+
+// DefaultNormalizeOptions returns the options used when none are
+// configured. Fragments are kept even for deduplication, since
+// single-page apps route on them.
+func DefaultNormalizeOptions() NormalizeOptions {
+	return NormalizeOptions{
+		SortQuery:       true,
+		StripTracking:   true,
+		TrackingParams:  DefaultTrackingParams,
+		IDNHost:         true,
+		PercentEncoding: true,
+		DotSegments:     true,
+		StripFragment:   false,
+	}
+}
+
+// NormalizeURL returns a canonical form of the URL suitable for
+// deduplication using the default options.
+func NormalizeURL(u string) (string, error) {
+	return NormalizeURLWithOptions(u, DefaultNormalizeOptions())
+}
+
+// CanonicalURL returns the deduplication key of a destination: its
+// canonical form under opts, or u itself if it does not parse
+func CanonicalURL(u string, opts NormalizeOptions) string {
+	canonical, err := NormalizeURLWithOptions(u, opts)
+	if err != nil {
+		return u
+	}
+	return canonical
+}
+
+// NormalizeURLWithOptions returns a canonical form of the URL. It always
+// lowercases the host, strips default ports and trims trailing slashes
+// (except for root path); the remaining steps are selected by opts.
+func NormalizeURLWithOptions(u string, opts NormalizeOptions) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if opts.IDNHost {
+		host = toASCIIHost(host)
+	}
+	port := parsed.Port()
+	// Remove default ports
+	if (parsed.Scheme == "http" && port == "80") || (parsed.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	switch {
+	case port != "":
+		parsed.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		parsed.Host = "[" + host + "]"
+	default:
+		parsed.Host = host
+	}
+
+	path := parsed.EscapedPath()
+	if opts.PercentEncoding {
+		path = normalizeEscapes(path)
+	}
+	if opts.DotSegments && strings.HasPrefix(path, "/") {
+		path = removeDotSegments(path)
+	}
+	if path != "/" {
+		path = strings.TrimRight(path, "/")
+	}
+	// An empty path is equivalent to the root path (RFC 3986 6.2.3)
+	if path == "" && parsed.Host != "" {
+		path = "/"
+	}
+	if parsed.Path, err = url.PathUnescape(path); err != nil {
+		return "", err
+	}
+	parsed.RawPath = path
+
+	parsed.RawQuery = normalizeQuery(parsed.RawQuery, opts)
+	parsed.ForceQuery = false
+
+	if opts.StripFragment {
+		parsed.Fragment = ""
+		parsed.RawFragment = ""
+	} else if opts.PercentEncoding && parsed.Fragment != "" {
+		fragment := normalizeEscapes(parsed.EscapedFragment())
+		if parsed.Fragment, err = url.PathUnescape(fragment); err != nil {
+			return "", err
+		}
+		parsed.RawFragment = fragment
+	}
+
+	return parsed.String(), nil
+}
+
+// normalizeQuery filters and orders the raw query string while keeping
+// the original encoding of each parameter.
+func normalizeQuery(rawQuery string, opts NormalizeOptions) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	type param struct {
+		key string
+		raw string
+	}
+	var params []param
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+		if opts.PercentEncoding {
+			raw = normalizeEscapes(raw)
+		}
+		key, _, _ := strings.Cut(raw, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if opts.StripTracking && isTrackingParam(key, opts.TrackingParams) {
+			continue
+		}
+		params = append(params, param{key: key, raw: raw})
+	}
+
+	if opts.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return params[i].key < params[j].key
+		})
+	}
+
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.raw
+	}
+	return strings.Join(parts, "&")
+}
+
+// isTrackingParam reports whether key matches one of the patterns.
+func isTrackingParam(key string, patterns []string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters and
+// uppercases the hex digits of every remaining escape (RFC 3986 6.2.2).
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	const upperHex = "0123456789ABCDEF"
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			c := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(c) {
+				b.WriteByte(c)
+			} else {
+				b.WriteByte('%')
+				b.WriteByte(upperHex[c>>4])
+				b.WriteByte(upperHex[c&15])
+			}
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// removeDotSegments resolves "." and ".." segments of an absolute path
+// as described in RFC 3986 5.2.4.
+func removeDotSegments(path string) string {
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, seg)
+			continue
+		}
+		// A trailing dot segment still denotes a directory
+		if last {
+			out = append(out, "")
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+func isUnreserved(c byte) bool {
+	return (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeURLDefaults(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"HTTPS://Example.COM:443/", "https://example.com/"},
+		{"http://example.com:80/path/", "http://example.com/path"},
+		{"http://example.com:8080/path", "http://example.com:8080/path"},
+		{"https://example.com/a/./b/../c", "https://example.com/a/c"},
+		{"https://example.com/%7euser/%2f", "https://example.com/~user/%2F"},
+		{"https://bücher.example/", "https://xn--bcher-kva.example/"},
+		// Deduplication ignores query order and tracking, but not fragments
+		{"https://x.com/?utm_source=n&id=1", "https://x.com/?id=1"},
+		{"https://x.com/?b=2&a=1&fbclid=x", "https://x.com/?a=1&b=2"},
+		{"https://app.example/#/inbox", "https://app.example/#/inbox"},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeURL(tt.in)
+		if err != nil {
+			t.Errorf("NormalizeURL(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("NormalizeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeURLOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts NormalizeOptions
+		in   string
+		want string
+	}{
+		{
+			name: "sort query",
+			opts: NormalizeOptions{SortQuery: true},
+			in:   "https://x.com/?b=2&a=1",
+			want: "https://x.com/?a=1&b=2",
+		},
+		{
+			name: "strip tracking",
+			opts: NormalizeOptions{StripTracking: true, TrackingParams: DefaultTrackingParams},
+			in:   "https://x.com/?utm_source=n&id=1&fbclid=abc",
+			want: "https://x.com/?id=1",
+		},
+		{
+			name: "strip custom tracking prefix",
+			opts: NormalizeOptions{StripTracking: true, TrackingParams: []string{"ref_*"}},
+			in:   "https://x.com/?ref_src=a&utm_source=n",
+			want: "https://x.com/?utm_source=n",
+		},
+		{
+			name: "strip fragment",
+			opts: NormalizeOptions{StripFragment: true},
+			in:   "https://x.com/page#top",
+			want: "https://x.com/page",
+		},
+		{
+			name: "dot segments off",
+			opts: NormalizeOptions{},
+			in:   "https://x.com/a/../b",
+			want: "https://x.com/a/../b",
+		},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeURLWithOptions(tt.in, tt.opts)
+		if err != nil {
+			t.Errorf("%s: error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: NormalizeURLWithOptions(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeDestination(t *testing.T) {
+	opts := DefaultNormalizeOptions()
+	opts.StripFragment = true
+	tests := []struct {
+		in, want string
+	}{
+		{"HTTPS://X.com:443/a/./b/", "https://x.com/a/b"},
+		{"https://x.com/?utm_source=n&id=1", "https://x.com/?utm_source=n&id=1"},
+		{"https://x.com/?b=2&a=1", "https://x.com/?b=2&a=1"},
+		{"https://x.com/page#top", "https://x.com/page#top"},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeURLWithOptions(tt.in, opts.destination())
+		if err != nil || got != tt.want {
+			t.Errorf("destination form of %q = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestShortenDedupesCanonicalURLs(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	shorten := func(rawURL string) ShortenResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.HandleShorten(w, httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(`{"url": "`+rawURL+`"}`)))
+		var resp ShortenResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.ShortCode == "" {
+			t.Fatalf("shorten %s: status %d: %s", rawURL, w.Code, w.Body)
+		}
+		return resp
+	}
+
+	const first = "https://8.8.8.8/p?utm_source=news&b=2&a=1"
+	code := shorten(first).ShortCode
+	for _, same := range []string{
+		"https://8.8.8.8/p?a=1&b=2",
+		"https://8.8.8.8/p?b=2&a=1&fbclid=abc",
+		"HTTPS://8.8.8.8:443/p/?a=1&utm_source=ads&b=2",
+	} {
+		if got := shorten(same); got.ShortCode != code || got.OriginalURL != first {
+			t.Errorf("shorten %s = %s -> %s, want %s -> %s", same, got.ShortCode, got.OriginalURL, code, first)
+		}
+	}
+	if other := shorten("https://8.8.8.8/p?a=1&b=3").ShortCode; other == code {
+		t.Errorf("different query reused %s", code)
+	}
+
+	// Visitors still go to the URL as first submitted
+	w := httptest.NewRecorder()
+	h.HandleRedirect(w, httptest.NewRequest(http.MethodGet, "/"+code, nil))
+	if location := w.Header().Get("Location"); location != first {
+		t.Errorf("redirect to %q, want %q", location, first)
+	}
+}
+
+func TestSetAliasKeyReindexes(t *testing.T) {
+	store := NewURLStore()
+	if err := store.Save(&URLMapping{ShortCode: "frag1", OriginalURL: "https://x.com/page#top"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.Aliases("https://x.com/page")); n != 0 {
+		t.Fatalf("default key matched across fragments: %d aliases", n)
+	}
+	opts := DefaultNormalizeOptions()
+	opts.StripFragment = true
+	store.SetAliasKey(func(u string) string { return CanonicalURL(u, opts) })
+	if n := len(store.Aliases("https://x.com/page")); n != 1 {
+		t.Errorf("after SetAliasKey: %d aliases, want 1", n)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pbkdf2Iterations follows the OWASP recommendation for PBKDF2-HMAC-SHA256
+	pbkdf2Iterations = 600000
+	pbkdf2SaltLen    = 16
+	pbkdf2KeyLen     = 32
+	passwordScheme   = "pbkdf2-sha256"
+
+	// Limits on stored hashes, which may come from imports: every password
+	// attempt costs their iteration count times their key blocks
+	maxPBKDF2Iterations = 2 * pbkdf2Iterations
+	minPBKDF2KeyLen     = 16
+	maxPBKDF2KeyLen     = 64
+	maxPBKDF2SaltLen    = 64
+
+	maxPasswordLength = 128
+)
+
+// HashPassword derives a salted PBKDF2-HMAC-SHA256 hash, encoded as
+// "pbkdf2-sha256$<iterations>$<salt>$<key>" with raw base64 fields.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, pbkdf2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, pbkdf2Iterations, pbkdf2KeyLen)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches an encoded hash
+func CheckPassword(encoded, password string) bool {
+	iterations, salt, want, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// parsePasswordHash decodes a hash made by HashPassword, rejecting any
+// whose parameters would make checking a password unreasonably slow
+func parsePasswordHash(encoded string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return 0, nil, nil, errors.New("unsupported password hash")
+	}
+	iterations, err = strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 || iterations > maxPBKDF2Iterations {
+		return 0, nil, nil, fmt.Errorf("password hash iterations must be 1 to %d", maxPBKDF2Iterations)
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(salt) == 0 || len(salt) > maxPBKDF2SaltLen {
+		return 0, nil, nil, errors.New("invalid password hash salt")
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) < minPBKDF2KeyLen || len(key) > maxPBKDF2KeyLen {
+		return 0, nil, nil, errors.New("invalid password hash key")
+	}
+	return iterations, salt, key, nil
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	var counter [4]byte
+	key := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+
+		t := make([]byte, hashLen)
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// attemptLimiter throttles password attempts per short code
+type attemptLimiter struct {
+	mu      sync.Mutex
+	max     int
+	window  time.Duration
+	windows map[string]*attemptWindow
+}
+
+type attemptWindow struct {
+	count int
+	start time.Time
+}
+
+func newAttemptLimiter(maxAttempts int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		max:     maxAttempts,
+		window:  window,
+		windows: make(map[string]*attemptWindow),
+	}
+}
+
+// attempt records an attempt for key and reports whether it is allowed.
+// Attempts are counted before the password is checked so concurrent
+// guesses cannot slip past the limit; if denied, it also returns how long
+// until the window resets.
+func (l *attemptLimiter) attempt(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.prune(now)
+		l.windows[key] = &attemptWindow{count: 1, start: now}
+		return true, 0
+	}
+	if w.count >= l.max {
+		return false, l.window - now.Sub(w.start)
+	}
+	w.count++
+	return true, 0
+}
+
+// reset clears attempts for key after a successful one
+func (l *attemptLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.windows, key)
+}
+
+// prune drops expired windows so the map does not grow without bound
+func (l *attemptLimiter) prune(now time.Time) {
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+}
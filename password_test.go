@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// Test vectors for PBKDF2-HMAC-SHA256 (RFC 7914 section 11 and the
+	// widely used RFC 6070 equivalents)
+	tests := []struct {
+		password, salt string
+		iterations     int
+		keyLen         int
+		want           string
+	}{
+		{"password", "salt", 1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, 32, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, tt.keyLen))
+		if got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		encoded, password string
+		want              bool
+	}{
+		{hash, "correct horse", true},
+		{hash, "correct horse ", false},
+		{hash, "", false},
+		{"", "correct horse", false},
+		{"bcrypt$1$c2FsdA$a2V5", "correct horse", false},
+		{"pbkdf2-sha256$0$c2FsdA$a2V5", "correct horse", false},
+		{"pbkdf2-sha256$1$!!$a2V5", "correct horse", false},
+		{"pbkdf2-sha256$2000000000$c2FsdA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "correct horse", false},
+		{"pbkdf2-sha256$1$c2FsdA$a2V5", "correct horse", false},
+	}
+	for _, tt := range tests {
+		if got := CheckPassword(tt.encoded, tt.password); got != tt.want {
+			t.Errorf("CheckPassword(%q, %q) = %v, want %v", tt.encoded, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestProtectedLinkFlow(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	mux := newMux(h)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if method == http.MethodPost && !strings.HasPrefix(body, "{") {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	const secret = "https://8.8.8.8/secret-plans"
+	w := serve(http.MethodPost, "/shorten", `{"url": "`+secret+`", "custom_code": "lock2", "password": "opensesame"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("shorten: status %d: %s", w.Code, w.Body)
+	}
+
+	steps := []struct {
+		name         string
+		method, path string
+		body         string
+		wantStatus   int
+		wantLocation string
+		hidden       string // must not appear in the body
+	}{
+		{"prompt", http.MethodGet, "/lock2", "", http.StatusOK, "", "secret-plans"},
+		{"preview", http.MethodGet, "/lock2+", "", http.StatusOK, "", "secret-plans"},
+		{"wrong password", http.MethodPost, "/lock2", "password=guess", http.StatusUnauthorized, "", "secret-plans"},
+		{"right password", http.MethodPost, "/lock2", "password=opensesame", http.StatusSeeOther, secret, ""},
+		{"get", http.MethodGet, "/api/urls/lock2", "", http.StatusOK, "", "secret-plans"},
+		{"rules", http.MethodGet, "/api/urls/lock2/rules", "", http.StatusOK, "", "secret-plans"},
+		{"list", http.MethodGet, "/api/urls", "", http.StatusOK, "", "secret-plans"},
+		{"destinations", http.MethodGet, "/api/destinations?url=" + url.QueryEscape(secret), "", http.StatusOK, "", "lock2"},
+		{"stats", http.MethodGet, "/api/stats", "", http.StatusOK, "", "secret-plans"},
+	}
+	for _, step := range steps {
+		w := serve(step.method, step.path, step.body)
+		if w.Code != step.wantStatus {
+			t.Errorf("%s: status %d, want %d", step.name, w.Code, step.wantStatus)
+		}
+		if location := w.Header().Get("Location"); location != step.wantLocation {
+			t.Errorf("%s: Location %q, want %q", step.name, location, step.wantLocation)
+		}
+		if step.hidden != "" && strings.Contains(w.Body.String(), step.hidden) {
+			t.Errorf("%s: response reveals %q: %s", step.name, step.hidden, w.Body)
+		}
+	}
+}
+
+func TestProtectedLinkAttemptLimit(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	h.attempts = newAttemptLimiter(2, time.Minute)
+	hash, err := HashPassword("opensesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.store.Save(&URLMapping{ShortCode: "lock3", OriginalURL: "https://8.8.8.8/", PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodPost, "/lock3", strings.NewReader("password=guess"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.HandleRedirect(w, r)
+		if w.Code != want {
+			t.Errorf("attempt %d: status %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
+
+func TestFailIfExistsHidesProtectedAlias(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	const secret = "https://8.8.8.8/secret-plans"
+	if err := h.store.Save(&URLMapping{ShortCode: "lock4", OriginalURL: secret, PasswordHash: testHash}); err != nil {
+		t.Fatal(err)
+	}
+	shorten := func() *httptest.ResponseRecorder {
+		body := `{"url": "` + secret + `", "dedupe": "fail-if-exists"}`
+		w := httptest.NewRecorder()
+		h.HandleShorten(w, httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body)))
+		return w
+	}
+
+	w := shorten()
+	if w.Code != http.StatusConflict || strings.Contains(w.Body.String(), "lock4") {
+		t.Errorf("status %d: %s, want 409 without the protected code", w.Code, w.Body)
+	}
+
+	if err := h.store.Save(&URLMapping{ShortCode: "open4", OriginalURL: secret}); err != nil {
+		t.Fatal(err)
+	}
+	w = shorten()
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "open4") || strings.Contains(w.Body.String(), "lock4") {
+		t.Errorf("status %d: %s, want 409 naming only open4", w.Code, w.Body)
+	}
+}
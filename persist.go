@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LoadStoreFile reads a store snapshot, in the JSON export format, into a
+// new store. A missing or empty file gives an empty store.
+func LoadStoreFile(path string) (*URLStore, error) {
+	store := NewURLStore()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := parseExportJSON(f)
+	if err == io.EOF {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, record := range records {
+		if record.err == nil {
+			record.err = store.Save(record.mapping)
+		}
+		if record.err != nil {
+			return nil, fmt.Errorf("%s: record %d: %v", path, i+1, record.err)
+		}
+	}
+	return store, nil
+}
+
+// WriteFile atomically replaces path with a snapshot of the store. The
+// file is only readable by its owner since it holds password hashes.
+func (s *URLStore) WriteFile(path string) error {
+	mappings := s.GetAll()
+	sortMappings(mappings)
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := writeExportJSON(f, mappings); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// checkWritable reports whether WriteFile could replace path, by creating
+// and removing a temporary file next to it
+func checkWritable(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Persister writes the store to a file whenever it has changed, at most
+// once per interval, and once more on shutdown via Flush.
+type Persister struct {
+	store    *URLStore
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	flushed uint64
+}
+
+// NewPersister creates a persister for a store loaded from path
+func NewPersister(store *URLStore, path string, interval time.Duration) *Persister {
+	return &Persister{
+		store:    store,
+		path:     path,
+		interval: interval,
+		flushed:  store.Changes(),
+	}
+}
+
+// Run flushes the store every interval until ctx is done
+func (p *Persister) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Flush(); err != nil {
+				slog.Error("Saving store failed", "file", p.path, "err", err)
+			}
+		}
+	}
+}
+
+// Flush writes the store if it changed since the last write
+func (p *Persister) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Read the counter first so changes made during the write are not lost
+	changes := p.store.Changes()
+	if changes == p.flushed {
+		return nil
+	}
+	if err := p.store.WriteFile(p.path); err != nil {
+		return err
+	}
+	p.flushed = changes
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Bootstring parameters for punycode (RFC 3492 section 5).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// toASCIIHost converts an internationalized host name to its ASCII
+// (punycode) form, label by label. It does not apply the full IDNA
+// mapping tables, so callers should lowercase the host beforehand.
+func toASCIIHost(host string) string {
+	// Ideographic and fullwidth full stops separate labels too
+	host = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(host)
+
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		if encoded, ok := punycodeEncode(label); ok {
+			labels[i] = "xn--" + encoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// punycodeEncode encodes a single label using the bootstring algorithm.
+// It reports false if the label is not valid UTF-8.
+func punycodeEncode(label string) (string, bool) {
+	if !utf8.ValidString(label) {
+		return "", false
+	}
+	runes := []rune(label)
+
+	out := make([]byte, 0, len(label)+8)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled < len(runes) {
+		// Find the smallest code point not yet handled
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+				continue
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), true
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// QRLevel is a QR code error correction level
+type QRLevel int
+
+// Error correction levels, recovering roughly 7%, 15%, 25% and 30% of
+// damaged codewords
+const (
+	QRLevelL QRLevel = iota
+	QRLevelM
+	QRLevelQ
+	QRLevelH
+)
+
+// ErrQRTooLong is returned when data does not fit in a version 40 symbol
+var ErrQRTooLong = errors.New("data too long for a QR code")
+
+// ParseQRLevel parses "L", "M", "Q" or "H" (case-insensitive)
+func ParseQRLevel(s string) (QRLevel, bool) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return QRLevelL, true
+	case "M":
+		return QRLevelM, true
+	case "Q":
+		return QRLevelQ, true
+	case "H":
+		return QRLevelH, true
+	}
+	return 0, false
+}
+
+// formatBits is the level's indicator in the format information
+func (l QRLevel) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+// Error correction codewords per block and number of blocks, indexed by
+// level and version (ISO/IEC 18004 table 9). Index 0 is unused.
+var qrECCPerBlock = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var qrNumBlocks = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// QRCode is an encoded QR code symbol
+type QRCode struct {
+	Size    int // modules per side
+	modules [][]bool
+}
+
+// EncodeQR encodes data in byte mode using the smallest version that fits
+// at the given error correction level, choosing the mask with the lowest
+// penalty score.
+func EncodeQR(data []byte, level QRLevel) (*QRCode, error) {
+	version := 1
+	for ; ; version++ {
+		if version > 40 {
+			return nil, ErrQRTooLong
+		}
+		countBits := 8
+		if version > 9 {
+			countBits = 16
+		}
+		if len(data) < 1<<countBits && 4+countBits+8*len(data) <= qrDataCodewords(version, level)*8 {
+			break
+		}
+	}
+
+	codewords := qrAddECC(qrDataStream(data, version, level), version, level)
+
+	q := newQRBuilder(version)
+	q.drawFunctionPatterns()
+	q.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(level, mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask) // masks are their own inverse
+	}
+	q.applyMask(best)
+	q.drawFormatBits(level, best)
+
+	return &QRCode{Size: q.size, modules: q.modules}, nil
+}
+
+// Dark reports whether the module at column x, row y is dark
+func (c *QRCode) Dark(x, y int) bool {
+	return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.modules[y][x]
+}
+
+// PNG renders the code as a square image of size pixels with a quiet zone
+// of at least margin modules. Modules are scaled by a whole number of
+// pixels; any remainder widens the quiet zone.
+func (c *QRCode) PNG(size, margin int) ([]byte, error) {
+	scale := size / (c.Size + 2*margin)
+	if scale < 1 {
+		scale = 1
+		size = c.Size + 2*margin
+	}
+	offset := (size - c.Size*scale) / 2
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				row := (offset+y*scale+dy)*img.Stride + offset + x*scale
+				for dx := 0; dx < scale; dx++ {
+					img.Pix[row+dx] = 1
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the code as a scalable image of size pixels with a quiet
+// zone of margin modules
+func (c *QRCode) SVG(size, margin int) []byte {
+	var buf bytes.Buffer
+	dim := c.Size + 2*margin
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, dim, dim)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, dim, dim)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// qrRawModules returns the number of modules available for data and error
+// correction in a version, after function patterns
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(version int, level QRLevel) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[level][version]*qrNumBlocks[level][version]
+}
+
+// qrDataStream builds the padded data codewords for a byte mode segment
+func qrDataStream(data []byte, version int, level QRLevel) []byte {
+	capacity := qrDataCodewords(version, level) * 8
+	var bits qrBits
+	bits.append(0x4, 4) // byte mode
+	if version > 9 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	terminator := capacity - bits.n
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-bits.n%8)%8)
+	for pad := 0xEC; bits.n < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	return bits.bytes
+}
+
+// qrBits is a big-endian bit buffer
+type qrBits struct {
+	bytes []byte
+	n     int
+}
+
+func (b *qrBits) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		if b.n%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if value>>i&1 != 0 {
+			b.bytes[b.n/8] |= 0x80 >> (b.n % 8)
+		}
+		b.n++
+	}
+}
+
+// qrAddECC splits data into blocks, appends Reed-Solomon error correction
+// to each and interleaves the result
+func qrAddECC(data []byte, version int, level QRLevel) []byte {
+	numBlocks := qrNumBlocks[level][version]
+	eccLen := qrECCPerBlock[level][version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	generator := rsGenerator(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		dataLen := shortLen - eccLen
+		if i >= numShort {
+			dataLen++
+		}
+		block := make([]byte, 0, shortLen+1)
+		block = append(block, data[k:k+dataLen]...)
+		ecc := rsRemainder(block, generator)
+		k += dataLen
+		if i < numShort {
+			// Pad short blocks so every block has the same layout
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, raw)
+	for i := 0; i <= shortLen; i++ {
+		for j, block := range blocks {
+			if j < numShort && i == shortLen-eccLen {
+				continue
+			}
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		carry := z >> 7
+		z <<= 1
+		z ^= carry * 0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// rsGenerator returns the coefficients, highest power first and without
+// the leading 1, of the Reed-Solomon generator polynomial of a degree
+func rsGenerator(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords for data
+func rsRemainder(data, generator []byte) []byte {
+	result := make([]byte, len(generator))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range generator {
+			result[i] ^= gfMul(coef, factor)
+		}
+	}
+	return result
+}
+
+// qrBuilder lays out modules, tracking which belong to function patterns
+type qrBuilder struct {
+	version    int
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+func newQRBuilder(version int) *qrBuilder {
+	size := version*4 + 17
+	q := &qrBuilder{version: version, size: size}
+	q.modules = make([][]bool, size)
+	q.isFunction = make([][]bool, size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.isFunction[i] = make([]bool, size)
+	}
+	return q
+}
+
+func (q *qrBuilder) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+func (q *qrBuilder) drawFunctionPatterns() {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	q.drawFinder(3, 3)
+	q.drawFinder(q.size-4, 3)
+	q.drawFinder(3, q.size-4)
+
+	positions := q.alignmentPositions()
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Skip the corners taken by finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			q.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format areas; the real bits are drawn after masking
+	q.drawFormatBits(0, 0)
+	q.drawVersion()
+}
+
+// drawFinder draws a finder pattern and its separator centred on (x, y)
+func (q *qrBuilder) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= q.size || yy >= q.size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			q.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (q *qrBuilder) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPositions returns the row and column centres of alignment
+// patterns, ascending
+func (q *qrBuilder) alignmentPositions() []int {
+	if q.version == 1 {
+		return nil
+	}
+	count := q.version/7 + 2
+	step := (q.version*8 + count*3 + 5) / (count*4 - 4) * 2
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, pos := count-1, q.size-7; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// drawFormatBits draws both copies of the level and mask, protected by a
+// BCH code, plus the dark module
+func (q *qrBuilder) drawFormatBits(level QRLevel, mask int) {
+	data := level.formatBits()<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// drawVersion draws both copies of the version information (version 7+)
+func (q *qrBuilder) drawVersion() {
+	if q.version < 7 {
+		return
+	}
+	rem := q.version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := q.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 != 0
+		a, b := q.size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords places codewords in the zigzag pattern, two columns at a
+// time from the bottom right, skipping function modules
+func (q *qrBuilder) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if q.isFunction[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by a mask pattern
+func (q *qrBuilder) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.isFunction[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the four rules of ISO/IEC 18004 7.8.3:
+// long runs, 2x2 blocks, finder-like patterns and dark/light imbalance
+func (q *qrBuilder) penalty() int {
+	score := 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+
+			// 1:1:3:1:1 dark pattern with four light modules on one side
+			for x := 0; x+7 <= q.size; x++ {
+				if !at(x, y, transpose) || at(x+1, y, transpose) || !at(x+2, y, transpose) ||
+					!at(x+3, y, transpose) || !at(x+4, y, transpose) || at(x+5, y, transpose) || !at(x+6, y, transpose) {
+					continue
+				}
+				if q.lightRun(x-4, x, y, transpose) || q.lightRun(x+7, x+11, y, transpose) {
+					score += 40
+				}
+			}
+		}
+	}
+
+	for y := 0; y+1 < q.size; y++ {
+		for x := 0; x+1 < q.size; x++ {
+			c := q.modules[y][x]
+			if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+				score += 3
+			}
+		}
+	}
+
+	dark := 0
+	for _, row := range q.modules {
+		for _, m := range row {
+			if m {
+				dark++
+			}
+		}
+	}
+	total := q.size * q.size
+	// Each full 5% away from an even balance costs 10
+	score += abs(dark*20-total*10) / total * 10
+	return score
+}
+
+// lightRun reports whether modules from..to (exclusive) on a line are all
+// light, treating the area outside the symbol as light quiet zone
+func (q *qrBuilder) lightRun(from, to, y int, transpose bool) bool {
+	for x := from; x < to; x++ {
+		if x < 0 || x >= q.size {
+			continue
+		}
+		if (transpose && q.modules[x][y]) || (!transpose && q.modules[y][x]) {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
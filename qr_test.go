@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Golden symbols were checked against rsc.io/qr with the same mask, and
+// the version 7 one also against github.com/boombuler/barcode, whose mask
+// penalty differs from the standard's. "#" is a dark module.
+var (
+	// "https://s.io/abc" at level L: version 1, mask 0
+	qrGoldenV1 = []string{
+		"#######...#...#######",
+		"#.....#...#...#.....#",
+		"#.###.#.#.#...#.###.#",
+		"#.###.#..#.#..#.###.#",
+		"#.###.#..#....#.###.#",
+		"#.....#..##...#.....#",
+		"#######.#.#.#.#######",
+		"........#.#..........",
+		"###.#####.#.###...#..",
+		"..##.#...#.##.###...#",
+		".#.#..#...####..#.###",
+		"##..##.###..#...#..#.",
+		"......#....#.#.#.#...",
+		"........######.##..##",
+		"#######.##..##..#.###",
+		"#.....#.#.#.##.##..#.",
+		"#.###.#.#..#.....#..#",
+		"#.###.#..#.##.#.##...",
+		"#.###.#.#..##...#.#.#",
+		"#.....#.##......#..#.",
+		"#######.###.....##.##",
+	}
+	// "https://example.com/" and twelve "abcdefghij" at level L: version 7,
+	// mask 2, with both copies of the version information
+	qrGoldenV7 = []string{
+		"#######..##.##.#...#.....#.#####....#.#######",
+		"#.....#.###.#.#....#..###.###...##.#..#.....#",
+		"#.###.#..#...#.#..##...##.#####.##.#..#.###.#",
+		"#.###.#.#.#.##.####.###......#.#...##.#.###.#",
+		"#.###.#.....#.#....#######..###.#.###.#.###.#",
+		"#.....#.##...###.##.#...#.#....#.#....#.....#",
+		"#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######",
+		".........##.#.###..##...#..##...#.###........",
+		"#####.###.#..###.#########.....#.....#.#.#.#.",
+		"##.###..##.##...#..#.##..#...##..#.###....###",
+		"#####.##.###..###...#####.###...####..##.###.",
+		"#####...##.#..#.####......###...#..#..#####..",
+		"#####.#..#.#.#.####..#####....##..#..#.....#.",
+		".##..#..##.#..#....#.##..#.#####...###.#..#.#",
+		"....#.#..##.....###.##.##.#....#.####.###.##.",
+		"##.#...#.#.#.#...#.#....#..##.#.#.#########.#",
+		"..##..#####.#....##.###...#..###..#..#...#..#",
+		".##.##...#.###.#...#.#...#.#.####..###.#..###",
+		"#....#####..#.......#..##.###..#.###.####..#.",
+		"#.####...#...#.#...#...##.###...###.#.#####..",
+		"..#.#######.##.##########.#..###.#..#####..#.",
+		"....#...##.#..#....##...##...##....##...#.#.#",
+		"##..#.#.#....####...#.#.#.#....#.####.#.##.#.",
+		".#..#...##.#..#...#.#...#..##.#.##..#...#.##.",
+		"#...############.##.#######....#....######..#",
+		"#.#.##.####.#...#..#######..###.#.....#...###",
+		"..#..###...##..##.#.###...#....#.##.##..##.#.",
+		"#....#.###..#.#.###.#..##..##...####..#..##..",
+		"....###.##...#.####....#.#.....#....#...#...#",
+		".###...#...##.#....#######.#.####..#........#",
+		"##.#.##..#...........#....#......#####.....#.",
+		".#.#.#.##.####...###.#####.##.#.##.#..#...#..",
+		"###..####...#....##.....#....#.#.##....##...#",
+		"##...#.##..#.#.#...#######.#####...###...##.#",
+		"....#.#####.......#..##...#....#.##.##.##.##.",
+		".####.....##.###....#####..##.#.#####.#..##..",
+		"#..##.#...#..#.####.#####.#..###.##.#####..##",
+		"........#.###.#.....#...##..###.#..##...##..#",
+		"#######.##.#####...##.#.#.##.....##.#.#.##.#.",
+		"#.....#...###.#....##...##.####.##.##...#.###",
+		"#.###.#.#..#####..#.######....##..#.#####..#.",
+		"#.###.#.#...#...#.##.....#...##......######..",
+		"#.###.#.#.####.##.#..####.#....#.####....##.#",
+		"#.....#.##..#...##..##.....##.#.##...#..###..",
+		"#######.###..#.#####..#####....#....#.#.#..#.",
+	}
+)
+
+func TestEncodeQRGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"version 1", "https://s.io/abc", qrGoldenV1},
+		{"version 7", "https://example.com/" + strings.Repeat("abcdefghij", 12), qrGoldenV7},
+	}
+	for _, tt := range tests {
+		c, err := EncodeQR([]byte(tt.data), QRLevelL)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if c.Size != len(tt.want) {
+			t.Fatalf("%s: size %d, want %d", tt.name, c.Size, len(tt.want))
+		}
+		for y, row := range tt.want {
+			var got strings.Builder
+			for x := 0; x < c.Size; x++ {
+				if c.Dark(x, y) {
+					got.WriteByte('#')
+				} else {
+					got.WriteByte('.')
+				}
+			}
+			if got.String() != row {
+				t.Errorf("%s: row %d\n got %s\nwant %s", tt.name, y, got.String(), row)
+			}
+		}
+	}
+}
@@ -41,28 +41,3 @@ func ValidateURL(u string) bool {
 	scheme := strings.ToLower(parsed.Scheme)
 	return scheme == "http" || scheme == "https"
 }
-
-// NormalizeURL returns a canonical form of the URL suitable for
-// deduplication. It lowercases the host, strips default ports and
-// trims trailing slashes (except for root path).
-func NormalizeURL(u string) (string, error) {
-	parsed, err := url.Parse(u)
-	if err != nil {
-		return "", err
-	}
-
-	parsed.Host = strings.ToLower(parsed.Host)
-
-	// Remove default ports
-	if (parsed.Scheme == "http" && strings.HasSuffix(parsed.Host, ":80")) ||
-		(parsed.Scheme == "https" && strings.HasSuffix(parsed.Host, ":443")) {
-		hostParts := strings.Split(parsed.Host, ":")
-		parsed.Host = hostParts[0]
-	}
-
-	if parsed.Path != "/" {
-		parsed.Path = strings.TrimRight(parsed.Path, "/")
-	}
-
-	return parsed.String(), nil
-}
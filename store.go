@@ -2,105 +2,392 @@ package main
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 )
 
 // URLMapping represents a shortened URL mapping
 type URLMapping struct {
-	ShortCode   string    `json:"short_code"`
-	OriginalURL string    `json:"original_url"`
-	CreatedAt   time.Time `json:"created_at"`
-	Clicks      int       `json:"clicks"`
+	ShortCode    string    `json:"short_code"`
+	Domain       string    `json:"domain,omitempty"` // empty for the default domain
+	OriginalURL  string    `json:"original_url"`
+	CreatedAt    time.Time `json:"created_at"`
+	Clicks       int       `json:"clicks"`
+	Protected    bool      `json:"protected,omitempty"`
+	PasswordHash string    `json:"-"`
+	Preview      bool      `json:"preview,omitempty"`
+
+	// NotBefore and NotAfter bound when the link redirects. Outside the
+	// window visitors get FallbackURL or a "not available" page.
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	FallbackURL string     `json:"fallback_url,omitempty"`
+
+	// Rules and GeoRules pick a different destination by visitor platform
+	// or country; OriginalURL remains the default
+	Rules    []RedirectRule `json:"rules,omitempty"`
+	GeoRules []GeoRule      `json:"geo_rules,omitempty"`
+
+	// Languages maps lowercase language tags to localized destinations,
+	// chosen from the visitor's Accept-Language header
+	Languages map[string]string `json:"languages,omitempty"`
+
+	// Variants split the remaining traffic between weighted destinations
+	Variants []Variant `json:"variants,omitempty"`
+}
+
+// linkKey identifies a short code within a domain. Codes on the default
+// domain are their own key; others are qualified as "domain/code".
+func linkKey(domain, shortCode string) string {
+	if domain == "" {
+		return shortCode
+	}
+	return domain + "/" + shortCode
+}
+
+// key returns the store key of the mapping
+func (m *URLMapping) key() string {
+	return linkKey(m.Domain, m.ShortCode)
+}
+
+// clone returns a copy of the mapping so callers can read it without
+// holding the store lock
+func (m *URLMapping) clone() *URLMapping {
+	c := *m
+	// Variant click counts are updated in place, so they are not shared
+	if m.Variants != nil {
+		c.Variants = append([]Variant(nil), m.Variants...)
+	}
+	return &c
+}
+
+// redacted returns the mapping without the destinations and password hash
+// of a protected link, for showing to anyone who has not given its password
+func (m *URLMapping) redacted() *URLMapping {
+	if !m.Protected {
+		return m
+	}
+	c := *m
+	c.OriginalURL, c.FallbackURL, c.PasswordHash = "", "", ""
+	c.Rules, c.GeoRules, c.Variants, c.Languages = nil, nil, nil, nil
+	return &c
+}
+
+// isPlain reports whether the mapping has no per-link options, so it can
+// be handed out again to anyone shortening the same URL.
+func (m *URLMapping) isPlain() bool {
+	return m.PasswordHash == "" && !m.Preview &&
+		m.NotBefore == nil && m.NotAfter == nil && m.FallbackURL == "" &&
+		len(m.Rules) == 0 && len(m.GeoRules) == 0 &&
+		len(m.Languages) == 0 && len(m.Variants) == 0
 }
 
-// URLStore manages URL mappings
+// notYetActive reports whether t is before the link's activation window
+func (m *URLMapping) notYetActive(t time.Time) bool {
+	return m.NotBefore != nil && t.Before(*m.NotBefore)
+}
+
+// expired reports whether t is after the link's activation window
+func (m *URLMapping) expired(t time.Time) bool {
+	return m.NotAfter != nil && !t.Before(*m.NotAfter)
+}
+
+// URLStore manages URL mappings. Mappings are looked up by their linkKey,
+// so the same short code can exist once per domain.
 type URLStore struct {
-	mu       sync.RWMutex
-	urls     map[string]*URLMapping
-	reverse  map[string]string // original URL -> short code for deduplication
+	mu      sync.RWMutex
+	urls    map[string]*URLMapping
+	reverse map[string]map[string]struct{} // alias key -> link keys (aliases) for deduplication
+	changes uint64                         // bumped on every modification, for persistence
+
+	// aliasKey maps an original URL to the key it is deduplicated by
+	aliasKey func(originalURL string) string
+
+	// Time spent waiting for mu, for metrics
+	readWait  *histogram
+	writeWait *histogram
 }
 
 // NewURLStore creates a new URL store
 func NewURLStore() *URLStore {
 	return &URLStore{
 		urls:    make(map[string]*URLMapping),
-		reverse: make(map[string]string),
+		reverse: make(map[string]map[string]struct{}),
+		aliasKey: func(originalURL string) string {
+			return CanonicalURL(originalURL, DefaultNormalizeOptions())
+		},
+
+		readWait:  newHistogram(lockWaitBuckets),
+		writeWait: newHistogram(lockWaitBuckets),
 	}
 }
 
-// Save stores a new URL mapping
-func (s *URLStore) Save(shortCode, originalURL string) error {
+// SetAliasKey changes how original URLs are matched for deduplication and
+// reindexes the stored links
+func (s *URLStore) SetAliasKey(fn func(originalURL string) string) {
+	s.lock()
+	defer s.mu.Unlock()
+
+	s.aliasKey = fn
+	s.reverse = make(map[string]map[string]struct{})
+	for key, mapping := range s.urls {
+		s.indexLocked(key, mapping)
+	}
+}
+
+// lock takes the write lock, recording how long it waited
+func (s *URLStore) lock() {
+	start := time.Now()
 	s.mu.Lock()
+	s.writeWait.observe(time.Since(start))
+}
+
+// rlock takes the read lock, recording how long it waited
+func (s *URLStore) rlock() {
+	start := time.Now()
+	s.mu.RLock()
+	s.readWait.observe(time.Since(start))
+}
+
+// Save stores a new URL mapping, stamping CreatedAt if it is unset
+func (s *URLStore) Save(mapping *URLMapping) error {
+	s.lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.urls[shortCode]; exists {
+	return s.saveLocked(mapping)
+}
+
+func (s *URLStore) saveLocked(mapping *URLMapping) error {
+	key := mapping.key()
+	if _, exists := s.urls[key]; exists {
 		return errors.New("short code already exists")
 	}
 
-	mapping := &URLMapping{
-		ShortCode:   shortCode,
-		OriginalURL: originalURL,
-		CreatedAt:   time.Now(),
-		Clicks:      0,
+	if mapping.CreatedAt.IsZero() {
+		mapping.CreatedAt = time.Now()
 	}
+	mapping.Protected = mapping.PasswordHash != ""
 
-	s.urls[shortCode] = mapping
-	s.reverse[originalURL] = shortCode
+	s.changes++
+	s.urls[key] = mapping
+	s.indexLocked(key, mapping)
 
 	return nil
 }
 
-// Get retrieves the original URL for a short code
-func (s *URLStore) Get(shortCode string) (*URLMapping, error) {
-	s.mu.RLock()
+// indexLocked adds a link key to the aliases of its original URL
+func (s *URLStore) indexLocked(key string, mapping *URLMapping) {
+	aliasKey := s.aliasKey(mapping.OriginalURL)
+	keys, ok := s.reverse[aliasKey]
+	if !ok {
+		keys = make(map[string]struct{})
+		s.reverse[aliasKey] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// Get retrieves a copy of the mapping for a link key
+func (s *URLStore) Get(key string) (*URLMapping, error) {
+	s.rlock()
 	defer s.mu.RUnlock()
 
-	mapping, exists := s.urls[shortCode]
+	return s.getLocked(key)
+}
+
+func (s *URLStore) getLocked(key string) (*URLMapping, error) {
+	mapping, exists := s.urls[key]
 	if !exists {
 		return nil, errors.New("short code not found")
 	}
 
-	return mapping, nil
+	return mapping.clone(), nil
 }
 
-// IncrementClicks increments the click counter for a short code
-func (s *URLStore) IncrementClicks(shortCode string) {
-	s.mu.Lock()
+// Update applies fn to the stored mapping for a link key while holding
+// the write lock. fn must replace slice and map fields rather than modify
+// them in place, since copies handed out earlier share them.
+func (s *URLStore) Update(key string, fn func(*URLMapping) error) (*URLMapping, error) {
+	s.lock()
 	defer s.mu.Unlock()
 
-	if mapping, exists := s.urls[shortCode]; exists {
-		mapping.Clicks++
+	mapping, exists := s.urls[key]
+	if !exists {
+		return nil, errors.New("short code not found")
+	}
+
+	updated := mapping.clone()
+	if err := fn(updated); err != nil {
+		return nil, err
 	}
+	// Identity and destination are indexed, so they cannot change here
+	updated.ShortCode = mapping.ShortCode
+	updated.Domain = mapping.Domain
+	updated.OriginalURL = mapping.OriginalURL
+	s.urls[key] = updated
+	s.changes++
+
+	return updated.clone(), nil
 }
 
-// GetByOriginalURL retrieves the short code for an original URL
-func (s *URLStore) GetByOriginalURL(originalURL string) (string, bool) {
-	s.mu.RLock()
+// RecordClick increments the click counter for a link key and, if
+// variant is a valid index, the counter of that A/B variant
+func (s *URLStore) RecordClick(key string, variant int) {
+	s.lock()
+	defer s.mu.Unlock()
+
+	mapping, exists := s.urls[key]
+	if !exists {
+		return
+	}
+	mapping.Clicks++
+	s.changes++
+	if variant >= 0 && variant < len(mapping.Variants) {
+		mapping.Variants[variant].Clicks++
+	}
+}
+
+// Aliases returns every mapping whose original URL has the same alias key
+// as originalURL, oldest first
+func (s *URLStore) Aliases(originalURL string) []*URLMapping {
+	s.rlock()
 	defer s.mu.RUnlock()
 
-	shortCode, exists := s.reverse[originalURL]
-	return shortCode, exists
+	return s.aliasesLocked(originalURL)
+}
+
+func (s *URLStore) aliasesLocked(originalURL string) []*URLMapping {
+	keys := s.reverse[s.aliasKey(originalURL)]
+	mappings := make([]*URLMapping, 0, len(keys))
+	for key := range keys {
+		mappings = append(mappings, s.urls[key].clone())
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		if !mappings[i].CreatedAt.Equal(mappings[j].CreatedAt) {
+			return mappings[i].CreatedAt.Before(mappings[j].CreatedAt)
+		}
+		return mappings[i].ShortCode < mappings[j].ShortCode
+	})
+	return mappings
+}
+
+// Delete removes a link key and drops it from its destination's aliases
+func (s *URLStore) Delete(key string) error {
+	s.lock()
+	defer s.mu.Unlock()
+
+	return s.deleteLocked(key)
 }
 
-// GetAll returns all URL mappings
+func (s *URLStore) deleteLocked(key string) error {
+	mapping, exists := s.urls[key]
+	if !exists {
+		return errors.New("short code not found")
+	}
+
+	delete(s.urls, key)
+	s.changes++
+	aliasKey := s.aliasKey(mapping.OriginalURL)
+	if keys, ok := s.reverse[aliasKey]; ok {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(s.reverse, aliasKey)
+		}
+	}
+
+	return nil
+}
+
+// GetAll returns copies of all URL mappings
 func (s *URLStore) GetAll() []*URLMapping {
-	s.mu.RLock()
+	s.rlock()
 	defer s.mu.RUnlock()
 
 	mappings := make([]*URLMapping, 0, len(s.urls))
 	for _, mapping := range s.urls {
-		mappings = append(mappings, mapping)
+		mappings = append(mappings, mapping.clone())
 	}
 
 	return mappings
 }
 
-// Exists checks if a short code exists
-func (s *URLStore) Exists(shortCode string) bool {
-	s.mu.RLock()
+// Count returns the number of stored mappings
+func (s *URLStore) Count() int {
+	s.rlock()
 	defer s.mu.RUnlock()
 
-	_, exists := s.urls[shortCode]
+	return len(s.urls)
+}
+
+// Exists checks if a link key exists
+func (s *URLStore) Exists(key string) bool {
+	s.rlock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.urls[key]
 	return exists
 }
+
+// Changes returns a counter that increases whenever the store is modified
+func (s *URLStore) Changes() uint64 {
+	s.rlock()
+	defer s.mu.RUnlock()
+
+	return s.changes
+}
+
+// Available reports whether the read lock can be taken within timeout,
+// i.e. the store is not stuck behind a writer
+func (s *URLStore) Available(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !s.mu.TryRLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.mu.RUnlock()
+	return true
+}
+
+// StoreTx gives access to the store inside Batch. Its methods must not be
+// used after fn returns.
+type StoreTx struct {
+	s *URLStore
+}
+
+// Batch runs fn while holding the write lock, so a series of lookups and
+// saves happens atomically with respect to other requests
+func (s *URLStore) Batch(fn func(tx *StoreTx)) {
+	s.lock()
+	defer s.mu.Unlock()
+
+	fn(&StoreTx{s: s})
+}
+
+// Get retrieves a copy of the mapping for a link key
+func (tx *StoreTx) Get(key string) (*URLMapping, error) {
+	return tx.s.getLocked(key)
+}
+
+// Exists checks if a link key exists
+func (tx *StoreTx) Exists(key string) bool {
+	_, exists := tx.s.urls[key]
+	return exists
+}
+
+// Aliases returns every mapping whose original URL has the same alias key
+// as originalURL, oldest first
+func (tx *StoreTx) Aliases(originalURL string) []*URLMapping {
+	return tx.s.aliasesLocked(originalURL)
+}
+
+// Save stores a new URL mapping, stamping CreatedAt if it is unset
+func (tx *StoreTx) Save(mapping *URLMapping) error {
+	return tx.s.saveLocked(mapping)
+}
+
+// Delete removes a link key and drops it from its destination's aliases
+func (tx *StoreTx) Delete(key string) error {
+	return tx.s.deleteLocked(key)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// Platforms that redirect rules can match on
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+	PlatformWindows = "windows"
+	PlatformMacOS   = "macos"
+	PlatformLinux   = "linux"
+	PlatformMobile  = "mobile"
+	PlatformDesktop = "desktop"
+)
+
+var knownPlatforms = map[string]bool{
+	PlatformIOS:     true,
+	PlatformAndroid: true,
+	PlatformWindows: true,
+	PlatformMacOS:   true,
+	PlatformLinux:   true,
+	PlatformMobile:  true,
+	PlatformDesktop: true,
+}
+
+// maxRedirectRules bounds the rules evaluated on every redirect
+const maxRedirectRules = 20
+
+var (
+	// ErrUnknownPlatform is returned for rules naming an unsupported platform
+	ErrUnknownPlatform = errors.New("unknown platform")
+	// ErrTooManyRules is returned when a link has more than maxRedirectRules
+	ErrTooManyRules = errors.New("too many rules")
+	// ErrInvalidCountry is returned for geo rules without valid country codes
+	ErrInvalidCountry = errors.New("invalid country code")
+	// ErrInvalidVariants is returned for splits without two positive weights
+	ErrInvalidVariants = errors.New("invalid variants")
+)
+
+// RedirectRule sends visitors on a platform to a different URL. Rules
+// are evaluated in order and the first match wins.
+type RedirectRule struct {
+	Platform string `json:"platform"`
+	URL      string `json:"url"`
+}
+
+// GeoRule sends visitors from any of the listed countries (ISO 3166-1
+// alpha-2 codes) to a different URL. Rules are evaluated in order.
+type GeoRule struct {
+	Countries []string `json:"countries"`
+	URL       string   `json:"url"`
+}
+
+// Variant is one weighted destination of an A/B split link. Clicks are
+// counted per variant; they are ignored on input.
+type Variant struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+	Clicks int    `json:"clicks"`
+}
+
+// maxVariantWeight keeps weight sums small enough to never overflow
+const maxVariantWeight = 1000000
+
+// variantCookiePrefix names the cookie that keeps a visitor on one variant
+const variantCookiePrefix = "sv_"
+
+// redirectDecision records which destination a visit was sent to and why
+type redirectDecision struct {
+	URL     string
+	Rule    string // e.g. "platform:ios" or "language:de", empty for the default destination
+	Variant int    // index into Variants, or -1
+}
+
+// selectDestination picks the destination for a visit: platform rules
+// first, then country rules, then the visitor's language, then a weighted
+// variant, falling back to the mapping's OriginalURL
+func (h *Handler) selectDestination(mapping *URLMapping, r *http.Request) redirectDecision {
+	if len(mapping.Rules) > 0 {
+		platforms := detectPlatforms(r.UserAgent())
+		for _, rule := range mapping.Rules {
+			if platforms[rule.Platform] {
+				return redirectDecision{URL: rule.URL, Rule: "platform:" + rule.Platform, Variant: -1}
+			}
+		}
+	}
+
+	if len(mapping.GeoRules) > 0 && h.geo != nil {
+		if country := h.geo.Lookup(h.clientIPs.ClientIP(r)); country != "" {
+			for _, rule := range mapping.GeoRules {
+				for _, c := range rule.Countries {
+					if c == country {
+						return redirectDecision{URL: rule.URL, Rule: "country:" + country, Variant: -1}
+					}
+				}
+			}
+		}
+	}
+
+	if tag := matchLanguage(r.Header.Get("Accept-Language"), mapping.Languages); tag != "" {
+		return redirectDecision{URL: mapping.Languages[tag], Rule: "language:" + tag, Variant: -1}
+	}
+
+	if len(mapping.Variants) > 0 {
+		i := stickyVariant(mapping, r)
+		if i < 0 {
+			i = pickVariant(mapping.Variants)
+		}
+		return redirectDecision{URL: mapping.Variants[i].URL, Rule: fmt.Sprintf("variant:%d", i), Variant: i}
+	}
+
+	return redirectDecision{URL: mapping.OriginalURL, Variant: -1}
+}
+
+// pickVariant chooses a variant at random in proportion to its weight
+func pickVariant(variants []Variant) int {
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+	n := rand.Intn(total)
+	for i, v := range variants {
+		if n < v.Weight {
+			return i
+		}
+		n -= v.Weight
+	}
+	return len(variants) - 1
+}
+
+// variantKey identifies a variant in the sticky cookie by its URL, so
+// visitors keep their variant even if the list is reordered
+func variantKey(v Variant) string {
+	sum := sha256.Sum256([]byte(v.URL))
+	return hex.EncodeToString(sum[:6])
+}
+
+// stickyVariant returns the variant a visitor was assigned before, or -1
+func stickyVariant(mapping *URLMapping, r *http.Request) int {
+	cookie, err := r.Cookie(variantCookiePrefix + mapping.ShortCode)
+	if err != nil {
+		return -1
+	}
+	for i, v := range mapping.Variants {
+		if v.Weight > 0 && variantKey(v) == cookie.Value {
+			return i
+		}
+	}
+	return -1
+}
+
+// setVariantCookie keeps the visitor on the same variant for later visits
+func setVariantCookie(w http.ResponseWriter, mapping *URLMapping, variant int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     variantCookiePrefix + mapping.ShortCode,
+		Value:    variantKey(mapping.Variants[variant]),
+		Path:     "/" + mapping.ShortCode,
+		MaxAge:   30 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// detectPlatforms classifies a User-Agent into the platforms it matches.
+// A device can match several, e.g. an iPhone is both "ios" and "mobile".
+func detectPlatforms(userAgent string) map[string]bool {
+	ua := strings.ToLower(userAgent)
+	p := make(map[string]bool)
+
+	switch {
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad") || strings.Contains(ua, "ipod"):
+		p[PlatformIOS] = true
+	case strings.Contains(ua, "android"):
+		p[PlatformAndroid] = true
+	case strings.Contains(ua, "windows"):
+		p[PlatformWindows] = true
+	case strings.Contains(ua, "macintosh") || strings.Contains(ua, "mac os x"):
+		p[PlatformMacOS] = true
+	case strings.Contains(ua, "linux") || strings.Contains(ua, "x11") || strings.Contains(ua, "cros"):
+		p[PlatformLinux] = true
+	}
+
+	if p[PlatformIOS] || p[PlatformAndroid] || strings.Contains(ua, "mobile") {
+		p[PlatformMobile] = true
+	} else if p[PlatformWindows] || p[PlatformMacOS] || p[PlatformLinux] {
+		p[PlatformDesktop] = true
+	}
+	return p
+}
+
+// prepareRules validates redirect rules and prepares their destinations
+// with prepare, the same way as the main URL
+func (h *Handler) prepareRules(prepare destinationFunc, rules []RedirectRule) ([]RedirectRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if len(rules) > maxRedirectRules {
+		return nil, &fieldError{"rules", ErrTooManyRules}
+	}
+
+	prepared := make([]RedirectRule, 0, len(rules))
+	for i, rule := range rules {
+		field := fmt.Sprintf("rules[%d]", i)
+		platform := strings.ToLower(strings.TrimSpace(rule.Platform))
+		if !knownPlatforms[platform] {
+			return nil, &fieldError{field, ErrUnknownPlatform}
+		}
+		destination, err := prepare(rule.URL)
+		if err != nil {
+			return nil, &fieldError{field, err}
+		}
+		prepared = append(prepared, RedirectRule{Platform: platform, URL: destination})
+	}
+	return prepared, nil
+}
+
+// prepareGeoRules validates country rules and prepares their destinations
+func (h *Handler) prepareGeoRules(prepare destinationFunc, rules []GeoRule) ([]GeoRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if len(rules) > maxRedirectRules {
+		return nil, &fieldError{"geo_rules", ErrTooManyRules}
+	}
+
+	prepared := make([]GeoRule, 0, len(rules))
+	for i, rule := range rules {
+		field := fmt.Sprintf("geo_rules[%d]", i)
+		if len(rule.Countries) == 0 {
+			return nil, &fieldError{field, ErrInvalidCountry}
+		}
+		countries := make([]string, len(rule.Countries))
+		for j, c := range rule.Countries {
+			countries[j] = strings.ToUpper(strings.TrimSpace(c))
+			if !isCountryCode(countries[j]) {
+				return nil, &fieldError{field, ErrInvalidCountry}
+			}
+		}
+		destination, err := prepare(rule.URL)
+		if err != nil {
+			return nil, &fieldError{field, err}
+		}
+		prepared = append(prepared, GeoRule{Countries: countries, URL: destination})
+	}
+	return prepared, nil
+}
+
+// prepareLanguages validates language variants and prepares their
+// destinations. Tags are stored in lowercase.
+func (h *Handler) prepareLanguages(prepare destinationFunc, languages map[string]string) (map[string]string, error) {
+	if len(languages) == 0 {
+		return nil, nil
+	}
+	if len(languages) > maxRedirectRules {
+		return nil, &fieldError{"languages", ErrTooManyRules}
+	}
+
+	prepared := make(map[string]string, len(languages))
+	for tag, rawURL := range languages {
+		field := "languages[" + tag + "]"
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !isLanguageTag(tag) {
+			return nil, &fieldError{field, ErrInvalidLanguage}
+		}
+		if _, dup := prepared[tag]; dup {
+			return nil, &fieldError{field, ErrInvalidLanguage}
+		}
+		destination, err := prepare(rawURL)
+		if err != nil {
+			return nil, &fieldError{field, err}
+		}
+		prepared[tag] = destination
+	}
+	return prepared, nil
+}
+
+// prepareVariants validates an A/B split and prepares its destinations
+func (h *Handler) prepareVariants(prepare destinationFunc, variants []Variant) ([]Variant, error) {
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	if len(variants) > maxRedirectRules {
+		return nil, &fieldError{"variants", ErrTooManyRules}
+	}
+	if len(variants) < 2 {
+		return nil, &fieldError{"variants", ErrInvalidVariants}
+	}
+
+	prepared := make([]Variant, 0, len(variants))
+	for i, v := range variants {
+		field := fmt.Sprintf("variants[%d]", i)
+		if v.Weight <= 0 || v.Weight > maxVariantWeight {
+			return nil, &fieldError{field, ErrInvalidVariants}
+		}
+		destination, err := prepare(v.URL)
+		if err != nil {
+			return nil, &fieldError{field, err}
+		}
+		prepared = append(prepared, Variant{URL: destination, Weight: v.Weight})
+	}
+	return prepared, nil
+}
+
+// carryVariantClicks keeps the click counts of variants whose URL is
+// still part of an edited split
+func carryVariantClicks(variants, previous []Variant) {
+	for i := range variants {
+		for _, p := range previous {
+			if p.URL == variants[i].URL {
+				variants[i].Clicks = p.Clicks
+			}
+		}
+	}
+}
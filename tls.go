@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a TLS certificate from a certificate and key file
+// pair and reloads it when the files change. Each handshake picks up the
+// current certificate, so reloading does not affect open connections.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the two files
+}
+
+// NewCertReloader loads a certificate and key pair
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate; it is meant for
+// tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Reload reads the files again. On error the previous certificate is kept.
+func (c *CertReloader) Reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// Watch reloads the certificate whenever either file's modification time
+// changes, checking every interval until ctx is done
+func (c *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime, err := c.filesModTime()
+			c.mu.RLock()
+			changed := err == nil && !modTime.Equal(c.modTime)
+			c.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			// Certificate and key are often replaced one after the other,
+			// so a failed load is retried on the next tick
+			if err := c.Reload(); err != nil {
+				slog.Warn("Certificate reload failed, keeping previous certificate", "err", err)
+				continue
+			}
+			slog.Info("Reloaded certificate", "file", c.certFile)
+		}
+	}
+}
+
+func (c *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// newTLSConfig creates the server TLS configuration for a certificate
+func newTLSConfig(certs *CertReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+}
+
+// httpsRedirect redirects plain HTTP requests to the same URL on HTTPS,
+// served on httpsPort
+func httpsRedirect(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if host == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// withHSTS adds a Strict-Transport-Security header to HTTPS responses
+func withHSTS(next http.Handler, maxAge time.Duration, includeSubdomains bool) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
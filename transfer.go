@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conflict policies for imports, deciding what happens to records whose
+// short code already exists
+const (
+	ConflictSkip      = "skip"      // keep the existing mapping
+	ConflictOverwrite = "overwrite" // replace the existing mapping
+	ConflictFail      = "fail"      // import nothing (default)
+)
+
+// exportColumns is the CSV layout of exports. Targeting options, which do
+// not fit in flat columns, are kept as a JSON object in "options". The
+// domain is empty for the default domain.
+var exportColumns = []string{
+	"short_code", "original_url", "created_at", "clicks", "password_hash",
+	"preview", "not_before", "not_after", "fallback_url", "options", "domain",
+}
+
+// ExportRecord is the full form of a mapping used by export and import.
+// It includes the password hash, where known, so protected links survive
+// a migration.
+type ExportRecord struct {
+	*URLMapping
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// ImportReport summarizes an import. In a dry run the counts describe what
+// would have happened. Conflicts on other than the default domain are
+// listed as domain/code.
+type ImportReport struct {
+	DryRun      bool          `json:"dry_run"`
+	Total       int           `json:"total"`
+	Created     int           `json:"created"`
+	Overwritten int           `json:"overwritten"`
+	Skipped     int           `json:"skipped"`
+	Invalid     int           `json:"invalid"`
+	Conflicts   []string      `json:"conflicts"`
+	Errors      []ImportError `json:"errors"`
+}
+
+// ImportError describes a record that could not be imported. Record is
+// 1-based, counting data rows or array elements.
+type ImportError struct {
+	Record    int    `json:"record"`
+	ShortCode string `json:"short_code,omitempty"`
+	Error     string `json:"error"`
+}
+
+// importRecord is one parsed record of an import file, or the reason it
+// could not be parsed
+type importRecord struct {
+	mapping *URLMapping
+	err     error
+}
+
+// HandleExport handles GET requests streaming every mapping as JSON
+// (default) or CSV, oldest first. Protected links are redacted, without
+// their password hash, unless revealProtected is set; full backups come
+// from the store file.
+func (h *Handler) HandleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		h.respondError(w, "Format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	mappings := h.store.GetAll()
+	sortMappings(mappings)
+	for i, mapping := range mappings {
+		mappings[i] = h.visible(mapping)
+	}
+
+	extendDeadlines(w)
+	filename := "urls-" + time.Now().UTC().Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	var err error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = writeExportCSV(w, mappings)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = writeExportJSON(w, mappings)
+	}
+	if err != nil {
+		// Headers are already sent, so the client sees a truncated file
+		slog.Error("Export failed", "err", err)
+	}
+}
+
+// sortMappings orders mappings oldest first, then by short code
+func sortMappings(mappings []*URLMapping) {
+	sort.Slice(mappings, func(i, j int) bool {
+		if !mappings[i].CreatedAt.Equal(mappings[j].CreatedAt) {
+			return mappings[i].CreatedAt.Before(mappings[j].CreatedAt)
+		}
+		return mappings[i].ShortCode < mappings[j].ShortCode
+	})
+}
+
+func writeExportJSON(w io.Writer, mappings []*URLMapping) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("[")
+	for i, mapping := range mappings {
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n  ")
+		record, err := json.Marshal(ExportRecord{URLMapping: mapping, PasswordHash: mapping.PasswordHash})
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(record); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("\n]\n")
+	return bw.Flush()
+}
+
+func writeExportCSV(w io.Writer, mappings []*URLMapping) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportColumns); err != nil {
+		return err
+	}
+	for _, m := range mappings {
+		options, err := exportOptions(m)
+		if err != nil {
+			return err
+		}
+		err = cw.Write([]string{
+			m.ShortCode,
+			m.OriginalURL,
+			m.CreatedAt.UTC().Format(time.RFC3339Nano),
+			strconv.Itoa(m.Clicks),
+			m.PasswordHash,
+			formatCSVBool(m.Preview),
+			formatCSVTime(m.NotBefore),
+			formatCSVTime(m.NotAfter),
+			m.FallbackURL,
+			options,
+			m.Domain,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportOptions encodes a mapping's targeting options as JSON, or "" if
+// it has none
+func exportOptions(m *URLMapping) (string, error) {
+	var options RulesRequest
+	if len(m.Rules) > 0 {
+		options.Rules = &m.Rules
+	}
+	if len(m.GeoRules) > 0 {
+		options.GeoRules = &m.GeoRules
+	}
+	if len(m.Variants) > 0 {
+		options.Variants = &m.Variants
+	}
+	if len(m.Languages) > 0 {
+		options.Languages = &m.Languages
+	}
+	if options == (RulesRequest{}) {
+		return "", nil
+	}
+	b, err := json.Marshal(options)
+	return string(b), err
+}
+
+func formatCSVBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return ""
+}
+
+func formatCSVTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// HandleImport handles POST requests loading mappings from an export,
+// keeping their short codes, creation dates and click counts. Query
+// parameters select the format (json or csv, detected if omitted, or the
+// bitly and yourls export layouts), the conflict policy and a dry run
+// that only reports what would happen.
+func (h *Handler) HandleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	policy := query.Get("conflict")
+	if policy == "" {
+		policy = ConflictFail
+	}
+	if policy != ConflictSkip && policy != ConflictOverwrite && policy != ConflictFail {
+		h.respondError(w, "Invalid conflict policy. Use skip, overwrite or fail", http.StatusBadRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+
+	extendDeadlines(w)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBody)
+	records, err := readImport(r.Body, query.Get("format"))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.respondError(w, fmt.Sprintf("Import must be at most %d MB", maxBatchBody>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		h.respondError(w, "Invalid import file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := h.importRecords(records, policy, dryRun)
+	statusCode := http.StatusOK
+	if policy == ConflictFail && len(report.Conflicts) > 0 {
+		statusCode = http.StatusConflict
+	}
+	h.respondJSON(w, statusCode, report)
+}
+
+// importRecords validates records and saves them under a single store
+// lock according to the conflict policy. With ConflictFail, nothing is
+// saved if any record conflicts.
+func (h *Handler) importRecords(records []importRecord, policy string, dryRun bool) ImportReport {
+	report := ImportReport{
+		DryRun:    dryRun,
+		Total:     len(records),
+		Conflicts: []string{},
+		Errors:    []ImportError{},
+	}
+	invalid := func(i int, code string, err error) {
+		report.Invalid++
+		report.Errors = append(report.Errors, ImportError{Record: i + 1, ShortCode: code, Error: err.Error()})
+	}
+
+	valid := make([]bool, len(records))
+	for i, record := range records {
+		if record.err != nil {
+			invalid(i, "", record.err)
+			continue
+		}
+		if err := h.prepareImport(record.mapping); err != nil {
+			invalid(i, record.mapping.ShortCode, err)
+			continue
+		}
+		valid[i] = true
+	}
+
+	h.store.Batch(func(tx *StoreTx) {
+		seen := make(map[string]bool)
+		conflict := make([]bool, len(records))
+		for i, record := range records {
+			if !valid[i] {
+				continue
+			}
+			key := record.mapping.key()
+			if seen[key] {
+				valid[i] = false
+				invalid(i, record.mapping.ShortCode, errors.New("duplicate short code in import"))
+				continue
+			}
+			seen[key] = true
+			if tx.Exists(key) {
+				conflict[i] = true
+				report.Conflicts = append(report.Conflicts, key)
+			}
+		}
+		if policy == ConflictFail && len(report.Conflicts) > 0 {
+			return
+		}
+
+		for i, record := range records {
+			if !valid[i] {
+				continue
+			}
+			switch {
+			case !conflict[i]:
+				report.Created++
+			case policy == ConflictSkip:
+				report.Skipped++
+				continue
+			default:
+				report.Overwritten++
+				if !dryRun {
+					tx.Delete(record.mapping.key())
+				}
+			}
+			if !dryRun {
+				tx.Save(record.mapping)
+			}
+		}
+	})
+
+	sort.SliceStable(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Record < report.Errors[j].Record
+	})
+	return report
+}
+
+// prepareImport validates an imported mapping and normalizes its URLs the
+// same way as a shorten request. Destinations are checked against the
+// blocklist but not resolved, so large imports do not depend on DNS.
+func (h *Handler) prepareImport(m *URLMapping) error {
+	if !isExistingShortCode(m.ShortCode) {
+		return errors.New("invalid short code")
+	}
+	domain, ok := h.domainFor(m.Domain)
+	if !ok {
+		return fmt.Errorf("unknown domain %q", m.Domain)
+	}
+	m.Domain = domain
+	if m.Protected && m.PasswordHash == "" {
+		return errors.New("protected link without password hash; export it from the store file")
+	}
+	if m.PasswordHash != "" {
+		if _, _, _, err := parsePasswordHash(m.PasswordHash); err != nil {
+			return err
+		}
+	}
+	if m.Clicks < 0 {
+		return errors.New("invalid clicks")
+	}
+	if m.NotBefore != nil && m.NotAfter != nil && !m.NotAfter.After(*m.NotBefore) {
+		return errors.New("not_after must be later than not_before")
+	}
+
+	var err error
+	if m.OriginalURL, err = h.importDestination(m.OriginalURL); err != nil {
+		return err
+	}
+	if m.FallbackURL != "" {
+		if m.FallbackURL, err = h.importDestination(m.FallbackURL); err != nil {
+			return &fieldError{"fallback_url", err}
+		}
+	}
+	if m.Rules, err = h.prepareRules(h.importDestination, m.Rules); err != nil {
+		return err
+	}
+	if m.GeoRules, err = h.prepareGeoRules(h.importDestination, m.GeoRules); err != nil {
+		return err
+	}
+	if m.Languages, err = h.prepareLanguages(h.importDestination, m.Languages); err != nil {
+		return err
+	}
+	variants, err := h.prepareVariants(h.importDestination, m.Variants)
+	if err != nil {
+		return err
+	}
+	for i := range variants {
+		variants[i].Clicks = m.Variants[i].Clicks
+		if variants[i].Clicks < 0 {
+			return &fieldError{fmt.Sprintf("variants[%d]", i), errors.New("invalid clicks")}
+		}
+	}
+	m.Variants = variants
+	return nil
+}
+
+// importDestination validates, normalizes and checks the reputation of an
+// imported destination, without the DNS lookups of prepareDestination
+func (h *Handler) importDestination(rawURL string) (string, error) {
+	if !ValidateURL(rawURL) {
+		return "", ErrInvalidURL
+	}
+	normalized, err := NormalizeURLWithOptions(rawURL, h.normalize.destination())
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	if err := h.checkReputationURL(u); err != nil {
+		return "", err
+	}
+	return normalized, nil
+}
+
+// readImport parses an import body in the given format, or detects our
+// own export format: bodies starting with '[' or '{' are JSON, anything
+// else CSV
+func readImport(body io.Reader, format string) ([]importRecord, error) {
+	br := bufio.NewReader(body)
+	if format == "" {
+		first, err := peekNonSpace(br)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		format = "csv"
+		if first == '[' || first == '{' {
+			format = "json"
+		}
+	}
+
+	switch format {
+	case "json":
+		return parseExportJSON(br)
+	case "csv":
+		return parseExportCSV(br)
+	case FormatBitly:
+		return parseForeign(br, bitlyLayout)
+	case FormatYOURLS:
+		return parseForeign(br, yourlsLayout)
+	default:
+		return nil, errors.New("format must be json, csv, bitly or yourls")
+	}
+}
+
+// parseExportJSON reads an array of ExportRecord, or an object with a
+// "urls" array such as the output of GET /api/urls
+func parseExportJSON(r io.Reader) ([]importRecord, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []json.RawMessage
+	if first == '{' {
+		var list struct {
+			URLs []json.RawMessage `json:"urls"`
+		}
+		if err := json.NewDecoder(br).Decode(&list); err != nil {
+			return nil, err
+		}
+		items = list.URLs
+	} else if err := json.NewDecoder(br).Decode(&items); err != nil {
+		return nil, err
+	}
+
+	records := make([]importRecord, len(items))
+	for i, item := range items {
+		var record ExportRecord
+		if err := json.Unmarshal(item, &record); err != nil {
+			records[i].err = err
+			continue
+		}
+		if record.URLMapping == nil {
+			records[i].err = errors.New("missing short_code and original_url")
+			continue
+		}
+		mapping := record.URLMapping
+		mapping.PasswordHash = record.PasswordHash
+		records[i].mapping = mapping
+	}
+	return records, nil
+}
+
+// parseExportCSV reads CSV with a header row naming exportColumns. Only
+// short_code and original_url are required; columns may be in any order
+// and unknown ones are ignored.
+func parseExportCSV(r io.Reader) ([]importRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"short_code", "original_url"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing %s column", required)
+		}
+	}
+
+	var records []importRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		mapping, err := parseExportRow(field)
+		records = append(records, importRecord{mapping: mapping, err: err})
+	}
+}
+
+func parseExportRow(field func(string) string) (*URLMapping, error) {
+	m := &URLMapping{
+		ShortCode:    field("short_code"),
+		Domain:       field("domain"),
+		OriginalURL:  field("original_url"),
+		PasswordHash: field("password_hash"),
+		FallbackURL:  field("fallback_url"),
+	}
+	var err error
+	if v := field("created_at"); v != "" {
+		if m.CreatedAt, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return nil, fmt.Errorf("invalid created_at %q", v)
+		}
+	}
+	if v := field("clicks"); v != "" {
+		if m.Clicks, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid clicks %q", v)
+		}
+	}
+	if v := field("preview"); v != "" {
+		if m.Preview, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid preview %q", v)
+		}
+	}
+	for _, t := range []struct {
+		name string
+		dst  **time.Time
+	}{{"not_before", &m.NotBefore}, {"not_after", &m.NotAfter}} {
+		if v := field(t.name); v != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", t.name, v)
+			}
+			*t.dst = &parsed
+		}
+	}
+	if v := field("options"); v != "" {
+		var options RulesRequest
+		if err := json.Unmarshal([]byte(v), &options); err != nil {
+			return nil, fmt.Errorf("invalid options: %v", err)
+		}
+		if options.Rules != nil {
+			m.Rules = *options.Rules
+		}
+		if options.GeoRules != nil {
+			m.GeoRules = *options.GeoRules
+		}
+		if options.Variants != nil {
+			m.Variants = *options.Variants
+		}
+		if options.Languages != nil {
+			m.Languages = *options.Languages
+		}
+	}
+	return m, nil
+}
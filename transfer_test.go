@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHash is a well-formed password hash that is cheap to check
+const testHash = passwordScheme + "$1$c2FsdA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+func TestExportProtectedLinks(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	links := []*URLMapping{
+		{ShortCode: "open1", OriginalURL: "https://8.8.8.8/public"},
+		{ShortCode: "lock1", OriginalURL: "https://8.8.8.8/secret-plans", PasswordHash: testHash},
+	}
+	for _, m := range links {
+		if err := h.store.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, reveal := range []bool{false, true} {
+		h.revealProtected = reveal
+		for _, format := range []string{"json", "csv"} {
+			r := httptest.NewRequest(http.MethodGet, "/api/export?format="+format, nil)
+			w := httptest.NewRecorder()
+			h.HandleExport(w, r)
+
+			body := w.Body.String()
+			if w.Code != http.StatusOK || !strings.Contains(body, "https://8.8.8.8/public") {
+				t.Fatalf("export %s: status %d: %s", format, w.Code, body)
+			}
+			for _, secret := range []string{testHash, "secret-plans"} {
+				if strings.Contains(body, secret) != reveal {
+					t.Errorf("export %s with revealProtected=%v: contains %q = %v", format, reveal, secret, !reveal)
+				}
+			}
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "urls.json")
+	if err := h.store.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), testHash) {
+		t.Errorf("store file lacks the password hash: %s", data)
+	}
+}
+
+// blockedHost is a ReputationChecker rejecting a single host
+type blockedHost string
+
+func (b blockedHost) Check(u *url.URL) error {
+	if u.Hostname() == string(b) {
+		return ErrDestinationBlocked
+	}
+	return nil
+}
+
+// postImport sends body to POST /api/import with the given query and
+// decodes the report
+func postImport(t *testing.T, h *Handler, query, body string) (ImportReport, int) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/import?"+query, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.HandleImport(w, r)
+	var report ImportReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("import: status %d: %s", w.Code, w.Body)
+	}
+	return report, w.Code
+}
+
+func TestImportValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		record string
+	}{
+		{"short code", `{"short_code": "a/b", "original_url": "https://8.8.8.8/"}`},
+		{"url", `{"short_code": "bad1", "original_url": "javascript:alert(1)"}`},
+		{"blocked url", `{"short_code": "bad2", "original_url": "https://evil.example/"}`},
+		{"fallback url", `{"short_code": "bad3", "original_url": "https://8.8.8.8/", "fallback_url": "ftp://8.8.8.8/"}`},
+		{"blocked fallback", `{"short_code": "bad4", "original_url": "https://8.8.8.8/", "fallback_url": "https://evil.example/"}`},
+		{"rule url", `{"short_code": "bad5", "original_url": "https://8.8.8.8/", "rules": [{"platform": "ios", "url": "https://evil.example/"}]}`},
+		{"rule platform", `{"short_code": "bad6", "original_url": "https://8.8.8.8/", "rules": [{"platform": "amiga", "url": "https://8.8.8.8/a"}]}`},
+		{"geo country", `{"short_code": "bad7", "original_url": "https://8.8.8.8/", "geo_rules": [{"countries": ["XYZ"], "url": "https://8.8.8.8/a"}]}`},
+		{"geo url", `{"short_code": "bad8", "original_url": "https://8.8.8.8/", "geo_rules": [{"countries": ["DE"], "url": "notaurl"}]}`},
+		{"language url", `{"short_code": "bad9", "original_url": "https://8.8.8.8/", "languages": {"de": "https://evil.example/de"}}`},
+		{"language tag", `{"short_code": "bad10", "original_url": "https://8.8.8.8/", "languages": {"not a tag": "https://8.8.8.8/de"}}`},
+		{"variant weight", `{"short_code": "bad11", "original_url": "https://8.8.8.8/", "variants": [{"url": "https://8.8.8.8/a", "weight": 0}, {"url": "https://8.8.8.8/b", "weight": 1}]}`},
+		{"single variant", `{"short_code": "bad12", "original_url": "https://8.8.8.8/", "variants": [{"url": "https://8.8.8.8/a", "weight": 1}]}`},
+		{"variant url", `{"short_code": "bad13", "original_url": "https://8.8.8.8/", "variants": [{"url": "https://evil.example/", "weight": 1}, {"url": "https://8.8.8.8/b", "weight": 1}]}`},
+		{"window", `{"short_code": "bad14", "original_url": "https://8.8.8.8/", "not_before": "2030-01-02T00:00:00Z", "not_after": "2030-01-01T00:00:00Z"}`},
+		{"clicks", `{"short_code": "bad15", "original_url": "https://8.8.8.8/", "clicks": -1}`},
+		{"password hash", `{"short_code": "bad16", "original_url": "https://8.8.8.8/", "password_hash": "md5$abc"}`},
+		{"hash iterations", `{"short_code": "bad18", "original_url": "https://8.8.8.8/", "password_hash": "pbkdf2-sha256$2000000000$c2FsdA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}`},
+		{"hash salt", `{"short_code": "bad19", "original_url": "https://8.8.8.8/", "password_hash": "pbkdf2-sha256$1000$!!$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}`},
+		{"empty hash salt", `{"short_code": "bad20", "original_url": "https://8.8.8.8/", "password_hash": "pbkdf2-sha256$1000$$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}`},
+		{"hash key", `{"short_code": "bad21", "original_url": "https://8.8.8.8/", "password_hash": "pbkdf2-sha256$1000$c2FsdA$a2V5"}`},
+		{"long hash key", `{"short_code": "bad22", "original_url": "https://8.8.8.8/", "password_hash": "pbkdf2-sha256$1000$c2FsdA$` + strings.Repeat("A", 1000) + `"}`},
+		{"hash fields", `{"short_code": "bad23", "original_url": "https://8.8.8.8/", "password_hash": "pbkdf2-sha256$1000$c2FsdA"}`},
+		{"redacted protected link", `{"short_code": "bad17", "original_url": "", "protected": true}`},
+	}
+	for _, tt := range tests {
+		h := NewHandler(NewURLStore())
+		h.reputation = blockedHost("evil.example")
+		report, code := postImport(t, h, "", "["+tt.record+"]")
+		if code != http.StatusOK || report.Invalid != 1 || report.Created != 0 {
+			t.Errorf("%s: status %d, report %+v, want the record rejected", tt.name, code, report)
+		}
+		if h.store.Count() != 0 {
+			t.Errorf("%s: record was saved", tt.name)
+		}
+	}
+}
+
+func TestImportNormalizesOptions(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	record := `[{"short_code": "opts1", "original_url": "HTTPS://Example.COM:443/a",
+		"fallback_url": "https://Example.COM/b/../fallback",
+		"rules": [{"platform": "IOS", "url": "HTTPS://APPS.example/"}],
+		"geo_rules": [{"countries": ["de"], "url": "https://Example.COM/de"}],
+		"languages": {"FR": "https://Example.COM/fr"},
+		"variants": [{"url": "https://Example.COM/v1", "weight": 1, "clicks": 4}, {"url": "https://Example.COM/v2", "weight": 3, "clicks": 9}]}]`
+	if report, code := postImport(t, h, "", record); code != http.StatusOK || report.Created != 1 {
+		t.Fatalf("import: status %d, report %+v", code, report)
+	}
+
+	m, err := h.store.Get("opts1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &URLMapping{
+		ShortCode:   "opts1",
+		OriginalURL: "https://example.com/a",
+		FallbackURL: "https://example.com/fallback",
+		Rules:       []RedirectRule{{Platform: "ios", URL: "https://apps.example/"}},
+		GeoRules:    []GeoRule{{Countries: []string{"DE"}, URL: "https://example.com/de"}},
+		Languages:   map[string]string{"fr": "https://example.com/fr"},
+		Variants: []Variant{
+			{URL: "https://example.com/v1", Weight: 1, Clicks: 4},
+			{URL: "https://example.com/v2", Weight: 3, Clicks: 9},
+		},
+		CreatedAt: m.CreatedAt,
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("imported %+v, want %+v", m, want)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := NewHandler(NewURLStore())
+	src.revealProtected = true
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	start, end := created.Add(time.Hour), created.Add(48*time.Hour)
+	links := []*URLMapping{
+		{ShortCode: "plain1", OriginalURL: "https://8.8.8.8/plain", CreatedAt: created, Clicks: 7},
+		{ShortCode: "lock1", OriginalURL: "https://8.8.8.8/secret", CreatedAt: created.Add(time.Minute), PasswordHash: testHash},
+		{ShortCode: "sched1", OriginalURL: "https://8.8.8.8/launch", CreatedAt: created.Add(2 * time.Minute),
+			Preview: true, NotBefore: &start, NotAfter: &end, FallbackURL: "https://8.8.8.8/soon"},
+		{ShortCode: "target1", OriginalURL: "https://8.8.8.8/app", CreatedAt: created.Add(3 * time.Minute),
+			Rules:     []RedirectRule{{Platform: "android", URL: "https://8.8.8.8/android"}},
+			GeoRules:  []GeoRule{{Countries: []string{"FR", "BE"}, URL: "https://8.8.8.8/fr"}},
+			Languages: map[string]string{"de": "https://8.8.8.8/de"},
+			Variants:  []Variant{{URL: "https://8.8.8.8/a", Weight: 1, Clicks: 2}, {URL: "https://8.8.8.8/b", Weight: 2, Clicks: 5}}},
+	}
+	for _, m := range links {
+		if err := src.store.Save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := src.store.GetAll()
+	sortMappings(want)
+
+	for _, format := range []string{"json", "csv"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/export?format="+format, nil)
+		w := httptest.NewRecorder()
+		src.HandleExport(w, r)
+
+		dst := NewHandler(NewURLStore())
+		report, code := postImport(t, dst, "", w.Body.String())
+		if code != http.StatusOK || report.Created != len(links) || report.Invalid != 0 {
+			t.Fatalf("%s: status %d, report %+v", format, code, report)
+		}
+		got := dst.store.GetAll()
+		sortMappings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s round trip:\n got %+v\nwant %+v", format, got, want)
+		}
+	}
+}
+
+func TestImportConflictPolicies(t *testing.T) {
+	body := `[{"short_code": "taken", "original_url": "https://8.8.8.8/new"},
+		{"short_code": "fresh", "original_url": "https://8.8.8.8/fresh"}]`
+
+	tests := []struct {
+		query       string
+		wantStatus  int
+		wantCreated int
+		wantURL     string // destination of "taken" afterwards
+		wantFresh   bool
+	}{
+		{"", http.StatusConflict, 0, "https://8.8.8.8/old", false},
+		{"conflict=skip", http.StatusOK, 1, "https://8.8.8.8/old", true},
+		{"conflict=overwrite", http.StatusOK, 1, "https://8.8.8.8/new", true},
+		{"conflict=overwrite&dry_run=true", http.StatusOK, 1, "https://8.8.8.8/old", false},
+	}
+	for _, tt := range tests {
+		h := NewHandler(NewURLStore())
+		if err := h.store.Save(&URLMapping{ShortCode: "taken", OriginalURL: "https://8.8.8.8/old"}); err != nil {
+			t.Fatal(err)
+		}
+		report, code := postImport(t, h, tt.query, body)
+		if code != tt.wantStatus || report.Created != tt.wantCreated {
+			t.Errorf("%q: status %d, report %+v", tt.query, code, report)
+		}
+		if !reflect.DeepEqual(report.Conflicts, []string{"taken"}) {
+			t.Errorf("%q: conflicts %v, want [taken]", tt.query, report.Conflicts)
+		}
+		if m, _ := h.store.Get("taken"); m.OriginalURL != tt.wantURL {
+			t.Errorf("%q: taken -> %s, want %s", tt.query, m.OriginalURL, tt.wantURL)
+		}
+		if _, err := h.store.Get("fresh"); (err == nil) != tt.wantFresh {
+			t.Errorf("%q: fresh imported = %v, want %v", tt.query, err == nil, tt.wantFresh)
+		}
+	}
+}
+
+func TestImportMalformedFile(t *testing.T) {
+	h := NewHandler(NewURLStore())
+	for _, body := range []string{`[{"short_code": `, "original_url\nhttps://8.8.8.8/\n"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/import", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.HandleImport(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("import %q: status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if n := h.store.Count(); n != 0 {
+		t.Errorf("malformed imports saved %d links", n)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
+	"net/url"
 )
 
 // ServeUI writes a small single-file web UI to the response.
@@ -11,14 +13,73 @@ func ServeUI(w http.ResponseWriter) {
 	fmt.Fprint(w, uiHTML)
 }
 
-var uiHTML = `<!doctype html>
-<html lang="en">
-<head>
-  <meta charset="utf-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1">
-  <title>Shawty URL</title>
-  <style>
-    * { margin: 0; padding: 0; box-sizing: border-box; }
+// ServePasswordPrompt renders the password form for a protected link.
+// A non-empty message is shown as an error below the form.
+func ServePasswordPrompt(w http.ResponseWriter, shortCode, message string, statusCode int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	passwordTemplate.Execute(w, struct {
+		Styles    template.CSS
+		ShortCode string
+		Message   string
+	}{template.CSS(uiStyles), shortCode, message})
+}
+
+// ServePreview renders the interstitial page showing where a link goes.
+// When visiting is true the page stands in for the redirect to target;
+// otherwise it was explicitly requested with the "/{code}+" suffix.
+// The destination of a protected link is not revealed.
+func ServePreview(w http.ResponseWriter, mapping *URLMapping, target string, visiting bool) {
+	data := struct {
+		Styles    template.CSS
+		ShortCode string
+		Host      string
+		URL       string
+		Target    string
+		Created   string
+		Clicks    int
+		Protected bool
+		Visiting  bool
+	}{
+		Styles:    template.CSS(uiStyles),
+		ShortCode: mapping.ShortCode,
+		Created:   mapping.CreatedAt.Format("January 2, 2006"),
+		Clicks:    mapping.Clicks,
+		Protected: mapping.PasswordHash != "",
+		Visiting:  visiting,
+	}
+	if data.Protected {
+		data.Target = "/" + mapping.ShortCode
+	} else {
+		data.URL = target
+		data.Target = target
+		if u, err := url.Parse(target); err == nil {
+			data.Host = u.Hostname()
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	previewTemplate.Execute(w, data)
+}
+
+// ServeUnavailable renders a page explaining that a link cannot be
+// followed right now.
+func ServeUnavailable(w http.ResponseWriter, title, detail string, statusCode int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	unavailableTemplate.Execute(w, struct {
+		Styles template.CSS
+		Title  string
+		Detail string
+	}{template.CSS(uiStyles), title, detail})
+}
+
+// uiStyles is shared by every page so they match the main UI
+const uiStyles = `    * { margin: 0; padding: 0; box-sizing: border-box; }
 
     :root {
       --primary: rgb(52, 73, 94);
@@ -93,7 +154,8 @@ var uiHTML = `<!doctype html>
     }
 
     input[type="url"],
-    input[type="text"] {
+    input[type="text"],
+    input[type="password"] {
       width: 100%;
       padding: 14px 16px;
       font-size: 16px;
@@ -127,6 +189,18 @@ var uiHTML = `<!doctype html>
       font-family: inherit;
     }
 
+    .button-link {
+      flex: 1;
+      display: block;
+      padding: 14px 24px;
+      font-size: 16px;
+      font-weight: 600;
+      border-radius: 12px;
+      text-align: center;
+      text-decoration: none;
+      transition: all 0.2s;
+    }
+
     .btn-primary {
       background: var(--primary);
       color: white;
@@ -219,6 +293,20 @@ var uiHTML = `<!doctype html>
       background: var(--success);
     }
 
+    .qr-code {
+      display: flex;
+      align-items: center;
+      gap: 16px;
+      margin-top: 12px;
+      padding: 12px 16px;
+      background: white;
+      border-radius: 8px;
+    }
+
+    .qr-code img {
+      flex: none;
+    }
+
     .original-url {
       color: var(--text-muted);
       font-size: 0.9rem;
@@ -310,6 +398,8 @@ var uiHTML = `<!doctype html>
       font-weight: 600;
       color: var(--primary);
       font-size: 1.1rem;
+      text-decoration: none;
+      word-break: break-all;
     }
 
     .url-item-clicks {
@@ -366,7 +456,16 @@ var uiHTML = `<!doctype html>
       .button-group { flex-direction: column; }
       .result-header { flex-direction: column; align-items: flex-start; gap: 8px; }
     }
-  </style>
+`
+
+var uiHTML = `<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Shawty URL</title>
+  <style>
+` + uiStyles + `  </style>
 </head>
 <body>
   <div class="container">
@@ -386,6 +485,11 @@ var uiHTML = `<!doctype html>
         <input id="code" type="text" placeholder="custom-code" />
       </div>
 
+      <div class="input-group">
+        <label for="password">Password (optional)</label>
+        <input id="password" type="password" placeholder="Require a password to open the link" autocomplete="new-password" />
+      </div>
+
       <div class="button-group">
         <button id="shorten" class="btn-primary">Shorten URL</button>
         <button id="toggle-list" class="btn-secondary">View All URLs</button>
@@ -400,6 +504,10 @@ var uiHTML = `<!doctype html>
           <button class="copy-btn" id="copy-btn">Copy</button>
         </div>
         <div class="original-url" id="original-url"></div>
+        <div class="qr-code">
+          <img id="qr-image" alt="QR code for the short URL" width="160" height="160" />
+          <a id="qr-download" class="button-link btn-secondary" href="#" download>Download QR code</a>
+        </div>
       </div>
 
       <div id="error" class="error-message"></div>
@@ -425,6 +533,7 @@ var uiHTML = `<!doctype html>
   <script>
     const urlInput = document.getElementById('url');
     const codeInput = document.getElementById('code');
+    const passwordInput = document.getElementById('password');
     const shortenBtn = document.getElementById('shorten');
     const toggleListBtn = document.getElementById('toggle-list');
     const resultCard = document.getElementById('result');
@@ -433,6 +542,8 @@ var uiHTML = `<!doctype html>
     const shortLink = document.getElementById('short-link');
     const originalUrl = document.getElementById('original-url');
     const copyBtn = document.getElementById('copy-btn');
+    const qrImage = document.getElementById('qr-image');
+    const qrDownload = document.getElementById('qr-download');
     const urlListSection = document.getElementById('url-list-section');
     const urlListContent = document.getElementById('url-list-content');
     const statsDiv = document.getElementById('stats');
@@ -450,6 +561,10 @@ var uiHTML = `<!doctype html>
       shortLink.href = data.short_url;
       shortLink.textContent = data.short_url;
       originalUrl.textContent = '→ ' + data.original_url;
+      const qrUrl = '/api/urls/' + encodeURIComponent(data.short_code) + '/qr';
+      qrImage.src = qrUrl + '?format=svg&size=160';
+      qrDownload.href = qrUrl + '?size=1024';
+      qrDownload.setAttribute('download', data.short_code + '.png');
       resultCard.classList.add('show');
       errorMsg.classList.remove('show');
       copyBtn.textContent = 'Copy';
@@ -466,6 +581,8 @@ var uiHTML = `<!doctype html>
       const body = { url: url };
       const customCode = codeInput.value.trim();
       if (customCode) body.custom_code = customCode;
+      const password = passwordInput.value;
+      if (password) body.password = password;
 
       loading.style.display = 'block';
       resultCard.classList.remove('show');
@@ -489,6 +606,7 @@ var uiHTML = `<!doctype html>
         showResult(data);
         urlInput.value = '';
         codeInput.value = '';
+        passwordInput.value = '';
 
         if (listVisible) {
           loadUrls();
@@ -530,10 +648,10 @@ var uiHTML = `<!doctype html>
           const item = document.createElement('div');
           item.className = 'url-item';
           item.innerHTML = '<div class="url-item-header">' +
-            '<span class="url-item-code">/' + url.short_code + '</span>' +
+            '<a class="url-item-code" href="' + url.short_url + '" target="_blank">' + url.short_url + (url.protected ? ' 🔒' : '') + '</a>' +
             '<span class="url-item-clicks">' + url.clicks + ' clicks</span>' +
             '</div>' +
-            '<div class="url-item-original">' + url.original_url + '</div>' +
+            '<div class="url-item-original">' + (url.protected ? 'Password protected' : url.original_url) + '</div>' +
             '<div class="url-item-date">Created: ' + date + '</div>';
           urlListContent.appendChild(item);
         });
@@ -579,6 +697,123 @@ var uiHTML = `<!doctype html>
     codeInput.addEventListener('keydown', (e) => {
       if (e.key === 'Enter') shorten();
     });
+
+    passwordInput.addEventListener('keydown', (e) => {
+      if (e.key === 'Enter') shorten();
+    });
   </script>
 </body>
 </html>`
+
+var passwordTemplate = template.Must(template.New("password").Parse(`<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>Protected link - Shawty URL</title>
+  <style>{{.Styles}}</style>
+</head>
+<body>
+  <div class="container">
+    <div class="header">
+      <h1>Shawty URL</h1>
+      <p>This link is password protected</p>
+    </div>
+
+    <div class="card">
+      <form method="post" action="/{{.ShortCode}}">
+        <div class="input-group">
+          <label for="password">Enter the password for /{{.ShortCode}}</label>
+          <input id="password" name="password" type="password" autocomplete="current-password" autofocus required />
+        </div>
+
+        <div class="button-group">
+          <button type="submit" class="btn-primary">Continue</button>
+        </div>
+      </form>
+      {{if .Message}}<div class="error-message show">{{.Message}}</div>{{end}}
+    </div>
+
+    <div class="footer">
+      Built with Go • Fast & Reliable • Open Source
+    </div>
+  </div>
+</body>
+</html>`))
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>Link preview - Shawty URL</title>
+  <style>{{.Styles}}</style>
+</head>
+<body>
+  <div class="container">
+    <div class="header">
+      <h1>Shawty URL</h1>
+      <p>{{if .Visiting}}Check where this link goes before you continue{{else}}Preview of /{{.ShortCode}}{{end}}</p>
+    </div>
+
+    <div class="card">
+      <div class="result-header">
+        <h3>{{if .Protected}}This link is password protected{{else}}This link goes to {{.Host}}{{end}}</h3>
+      </div>
+      {{if not .Protected}}<div class="original-url">→ {{.URL}}</div>{{end}}
+
+      <div class="stats" style="margin-top: 24px;">
+        <div class="stat-card">
+          <div class="stat-value" style="font-size: 1.2rem;">{{.Created}}</div>
+          <div class="stat-label">Created</div>
+        </div>
+        <div class="stat-card">
+          <div class="stat-value">{{.Clicks}}</div>
+          <div class="stat-label">Clicks</div>
+        </div>
+      </div>
+
+      <div class="button-group">
+        <a href="{{.Target}}" class="button-link btn-primary" rel="noreferrer noopener">Continue{{if .Host}} to {{.Host}}{{end}}</a>
+      </div>
+    </div>
+
+    <div class="footer">
+      Built with Go • Fast & Reliable • Open Source
+    </div>
+  </div>
+</body>
+</html>`))
+
+var unavailableTemplate = template.Must(template.New("unavailable").Parse(`<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>{{.Title}} - Shawty URL</title>
+  <style>{{.Styles}}</style>
+</head>
+<body>
+  <div class="container">
+    <div class="header">
+      <h1>Shawty URL</h1>
+      <p>{{.Title}}</p>
+    </div>
+
+    <div class="card">
+      <div class="original-url">{{.Detail}}</div>
+
+      <div class="button-group">
+        <a href="/" class="button-link btn-primary">Shorten your own link</a>
+      </div>
+    </div>
+
+    <div class="footer">
+      Built with Go • Fast & Reliable • Open Source
+    </div>
+  </div>
+</body>
+</html>`))